@@ -0,0 +1,141 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "sync"
+import "time"
+
+// Broadcaster fans out what is written to it to every connection accepted
+// by a listener, like an in-process pub/sub bus.  Connections join once
+// they are accepted, and see only what is written after that; those that
+// fail a write, usually because the client closed, are dropped.  Data
+// sent by clients is not read.  A slow client slows down the whole
+// broadcast, as each Write waits for every client to take its copy.  It
+// is safe for concurrent use.
+type Broadcaster struct {
+	listener *ChanListener
+	mtx      sync.Mutex
+	wmtx     sync.Mutex
+	conns    []*ChanConn
+	closed   bool
+	done     chan struct{}
+}
+
+// NewBroadcaster returns a Broadcaster that accepts every connection made
+// to listener, which it takes over: the caller must not accept from it.
+func NewBroadcaster(listener *ChanListener) *Broadcaster {
+	b := &Broadcaster{listener: listener, done: make(chan struct{})}
+	go b.acceptAll()
+	return b
+}
+
+// acceptAll adds connections as they are accepted, until the listener is
+// closed, or fails with an error that is not temporary, such as when its
+// deadline expires.  Temporary errors are retried after a backoff.
+func (b *Broadcaster) acceptAll() {
+	defer close(b.done)
+	var delay time.Duration
+	for {
+		conn, err := b.listener.AcceptChan()
+		if err != nil {
+			if ce, ok := err.(*ChanError); !ok || !ce.Temporary() {
+				return
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > time.Second {
+				delay = time.Second
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		b.mtx.Lock()
+		if b.closed {
+			b.mtx.Unlock()
+			conn.Close()
+			return
+		}
+		b.conns = append(b.conns, conn)
+		b.mtx.Unlock()
+	}
+}
+
+// Write sends a copy of p to every connection, and always succeeds, even
+// if there are none, unless the Broadcaster has been closed.  The copies
+// are written in turn, so all clients see writes in the same order.
+func (b *Broadcaster) Write(p []byte) (int, error) {
+	b.wmtx.Lock()
+	defer b.wmtx.Unlock()
+
+	b.mtx.Lock()
+	if b.closed {
+		b.mtx.Unlock()
+		return 0, ErrConnClosed
+	}
+	conns := b.conns
+	b.mtx.Unlock()
+
+	for _, conn := range conns {
+		if _, err := conn.Write(p); err != nil {
+			b.drop(conn)
+		}
+	}
+	return len(p), nil
+}
+
+// drop closes conn, and removes it from the connections.
+func (b *Broadcaster) drop(conn *ChanConn) {
+	conn.Close()
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	conns := make([]*ChanConn, 0, len(b.conns))
+	for _, x := range b.conns {
+		if x != conn {
+			conns = append(conns, x)
+		}
+	}
+	b.conns = conns
+}
+
+// Len returns the number of connections the Broadcaster writes to.
+func (b *Broadcaster) Len() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return len(b.conns)
+}
+
+// Close closes the listener, and all of the connections.
+func (b *Broadcaster) Close() error {
+	b.mtx.Lock()
+	if b.closed {
+		b.mtx.Unlock()
+		return ErrConnClosed
+	}
+	b.closed = true
+	conns := b.conns
+	b.conns = nil
+	b.mtx.Unlock()
+
+	err := b.listener.Close()
+	<-b.done
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "testing"
+import "time"
+
+func TestBroadcaster(t *testing.T) {
+	listener, err := ListenChan("broadcast")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	b := NewBroadcaster(listener)
+	defer b.Close()
+
+	var clients []*ChanConn
+	for i := 0; i < 3; i++ {
+		client, err := DialChan("broadcast")
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+			return
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	for b.Len() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n, err := b.Write([]byte("news")); n != 4 || err != nil {
+		t.Errorf("Unexpected write %d, %v", n, err)
+		return
+	}
+	for i, client := range clients {
+		buf := make([]byte, 10)
+		if n, err := client.Read(buf); err != nil || string(buf[:n]) != "news" {
+			t.Errorf("Client %d got %q, %v", i, buf[:n], err)
+		}
+	}
+
+	// A client that leaves is dropped by the next write.
+	clients[0].Close()
+	b.Write([]byte("more"))
+	if n := b.Len(); n != 2 {
+		t.Errorf("Expected 2 connections, got %d", n)
+	}
+}
+
+func TestBroadcasterClose(t *testing.T) {
+	listener, err := ListenChan("broadcast.close")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	b := NewBroadcaster(listener)
+	client, err := DialChan("broadcast.close")
+	if err != nil {
+		t.Errorf("Failed to dial: %v", err)
+		return
+	}
+	defer client.Close()
+	for b.Len() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.Close()
+	if _, err := b.Write([]byte("late")); err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed, got %v", err)
+	}
+	if _, err := client.Read(make([]byte, 10)); err == nil {
+		t.Errorf("Read succeeded after Close")
+	}
+}
+
+func TestBroadcasterAcceptTimeout(t *testing.T) {
+	listener, err := ListenChan("broadcast.timeout")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	listener.SetDeadline(time.Now().Add(-time.Second))
+	b := NewBroadcaster(listener)
+	defer b.Close()
+
+	// An expired deadline stops accepting, rather than spinning.
+	select {
+	case <-b.done:
+	case <-time.After(time.Second):
+		t.Errorf("Still accepting after the deadline expired")
+	}
+}
@@ -22,16 +22,62 @@
 // copying.
 package chanstream
 
+import "bufio"
+import "context"
+import "encoding/binary"
+import "fmt"
 import "net"
+import "sort"
 import "sync"
+import "sync/atomic"
 import "time"
 import "io"
+import "log"
+import "strconv"
+import "strings"
+
+// ErrorKind classifies a ChanError, so that callers can tell kinds of
+// failure apart without matching on the error text.
+type ErrorKind int
+
+const (
+	// KindOther is for errors that fit none of the other kinds.
+	KindOther ErrorKind = iota
+
+	// KindRefused means there was nobody to connect to.
+	KindRefused
+
+	// KindAddrInUse means the address is already being listened on.
+	KindAddrInUse
+
+	// KindTimeout means that a deadline expired.
+	KindTimeout
+
+	// KindQueueFull means that the listen backlog was exhausted.
+	KindQueueFull
+
+	// KindClosed means that the connection was closed.
+	KindClosed
+)
 
 // ChanError implements the error and net.Error interfaces.
 type ChanError struct {
-	err string
-	tmo bool
-	tmp bool
+	err  string
+	tmo  bool
+	tmp  bool
+	kind ErrorKind
+}
+
+// NewChanError returns a ChanError with the given message, reporting the
+// given values from Timeout and Temporary.  This allows code emulating
+// chanstream, such as shims and tests, to produce compatible errors.  Its
+// Kind is KindTimeout for a timeout, and KindOther otherwise.
+func NewChanError(msg string, timeout, temporary bool) *ChanError {
+	e := &ChanError{err: msg, tmo: timeout, tmp: temporary}
+	if timeout {
+		e.kind = KindTimeout
+	}
+	return e
 }
 
 // Error implements the error interface.
@@ -50,344 +96,3176 @@ func (e *ChanError) Temporary() bool {
 	return e.tmp
 }
 
+// Kind returns the category of the error.
+func (e *ChanError) Kind() ErrorKind {
+	return e.kind
+}
+
+// Is reports whether target is a ChanError identical to this one, which
+// allows errors.Is to match equivalent errors even if they are distinct
+// values.
+func (e *ChanError) Is(target error) bool {
+	t, ok := target.(*ChanError)
+	return ok && *t == *e
+}
+
 var (
 	// ErrConnRefused is reported when no listener is present and
 	// a client attempts to connect via Dial.
-	ErrConnRefused = &ChanError{err: "Connection refused."}
+	ErrConnRefused = &ChanError{err: "Connection refused.", kind: KindRefused}
 
 	// ErrAddrInUse is reported when a server tries to Listen but another
 	// Conn is already listening on the same address.
-	ErrAddrInUse = &ChanError{err: "Address in use."}
+	ErrAddrInUse = &ChanError{err: "Address in use.", kind: KindAddrInUse}
 
 	// ErrAcceptTimeout is reported when a request to Accept takes too
 	// long.  (Note that this is not normally reported -- the default
 	// is for no timeout to be used in Accept.)
-	ErrAcceptTimeout = &ChanError{err: "Accept timeout.", tmo: true}
+	ErrAcceptTimeout = &ChanError{err: "Accept timeout.", tmo: true,
+		kind: KindTimeout}
 
 	// ErrListenQFull is reported if the listen backlog (default 32)
 	// is exhausted.  This normally occurs if a server goroutine does
 	// not call Accept often enough.
-	ErrListenQFull = &ChanError{err: "Listen queue full.", tmp: true}
+	ErrListenQFull = &ChanError{err: "Listen queue full.", tmp: true,
+		kind: KindQueueFull}
 
 	// ErrConnClosed is reported when a peer closes the connection while
 	// trying to establish the connection or send data.
-	ErrConnClosed = &ChanError{err: "Connection closed."}
+	ErrConnClosed = &ChanError{err: "Connection closed.", kind: KindClosed}
 
 	// ErrConnTimeout is reported when a connection takes too long to
 	// be established.
-	ErrConnTimeout = &ChanError{err: "Connection timeout.", tmo: true}
+	ErrConnTimeout = &ChanError{err: "Connection timeout.", tmo: true,
+		kind: KindTimeout}
 
 	// ErrRdTimeout is reported when the read deadline on a connection
 	// expires whle trying to read.
-	ErrRdTimeout = &ChanError{err: "Read timeout.", tmo: true, tmp: true}
+	ErrRdTimeout = &ChanError{err: "Read timeout.", tmo: true, tmp: true,
+		kind: KindTimeout}
 
 	// ErrWrTimeout is reported when the write deadline on a connection
 	// expires whle trying to write.
-	ErrWrTimeout = &ChanError{err: "Write timeout.", tmo: true, tmp: true}
+	ErrWrTimeout = &ChanError{err: "Write timeout.", tmo: true, tmp: true,
+		kind: KindTimeout}
+
+	// ErrKeepAlive is reported by Read when the peer fails to answer a
+	// keepalive probe in time, see SetReadKeepAlive.
+	ErrKeepAlive = &ChanError{err: "Keepalive timeout.", tmo: true,
+		kind: KindTimeout}
+
+	// ErrIdleTimeout is reported when a read waits for data for longer
+	// than the idle timeout allows.
+	ErrIdleTimeout = &ChanError{err: "Idle timeout.", tmo: true, tmp: true,
+		kind: KindTimeout}
+
+	// ErrListenerClosed is reported when trying to Accept on a listener
+	// that has been closed.
+	ErrListenerClosed = &ChanError{err: "Listener closed.", kind: KindClosed}
+
+	// ErrAcceptCancelled is reported by AcceptChan when it is interrupted
+	// by Cancel.
+	ErrAcceptCancelled = &ChanError{err: "Accept cancelled."}
+
+	// ErrWouldBlock is reported by TryDialChan when the connection
+	// cannot be made without waiting for the server to accept it.
+	ErrWouldBlock = &ChanError{err: "Operation would block.", tmp: true}
+
+	// ErrInvalidAddr is reported by ParseChanAddr for a malformed address.
+	ErrInvalidAddr = &ChanError{err: "Invalid address."}
+
+	// ErrMsgTooLong is reported when writing more than the maximum
+	// message size allows.
+	ErrMsgTooLong = &ChanError{err: "Message too long."}
+
+	// ErrSelfPeer is reported when a connection would be connected to
+	// itself, which can only arise from misuse, and would otherwise hang.
+	ErrSelfPeer = &ChanError{err: "Connection is its own peer."}
+
+	// ErrReadLimit is reported by Read once a connection has read as
+	// much as SetReadLimit allows and the peer has sent more.
+	ErrReadLimit = &ChanError{err: "Read limit exceeded."}
+
+	// ErrNoRegistry is reported by the package-level functions that
+	// listen and dial once DisableDefaultRegistry has been called.
+	ErrNoRegistry = &ChanError{err: "Default registry disabled."}
 )
 
-// listeners acts as a registry of listeners.
-var listeners struct {
+// Network is a registry of listeners, in which names are looked up: a name
+// dialed on a Network reaches only a listener on the same Network.  The
+// package-level functions, such as ListenChan and DialChan, use a default
+// Network shared by the whole process.  Separate Networks keep, say,
+// plugins or tests apart from it, and from one another.  The zero value is
+// an empty Network, ready to use.
+type Network struct {
 	mtx sync.Mutex
 	lst map[string]*ChanListener
+	seq int
+
+	// registered is closed, and replaced, whenever a name is registered,
+	// to wake up DialWait.
+	registered chan struct{}
+}
+
+// NewNetwork returns a new, empty Network.
+func NewNetwork() *Network {
+	return new(Network)
+}
+
+// defaultNet is the Network used by the package-level functions, unless
+// defaultOff is set by DisableDefaultRegistry.
+var defaultNet = new(Network)
+var defaultOff int32
+
+// DisableDefaultRegistry turns off the default Network, so that the
+// package-level functions that listen and dial, such as ListenChan and
+// DialChan, fail with ErrNoRegistry.  Code must then be handed a Network
+// to use, which allows capability based isolation, as in a plugin host,
+// where each plugin should only reach the services it is given.
+// Listeners already on the default Network stay open, but can no longer
+// be dialed.  This cannot be undone.
+func DisableDefaultRegistry() {
+	atomic.StoreInt32(&defaultOff, 1)
+}
+
+// defaultNetwork returns the default Network, or nil if it is disabled.
+func defaultNetwork() *Network {
+	if atomic.LoadInt32(&defaultOff) != 0 {
+		return nil
+	}
+	return defaultNet
+}
+
+// register records listener under name, with n.mtx held.
+func (n *Network) register(name string, listener *ChanListener) {
+	n.lst[name] = listener
+	if n.registered != nil {
+		close(n.registered)
+		n.registered = nil
+	}
+}
+
+// Listen creates a listener for name on n, as ListenChan does on the
+// default Network.
+func (n *Network) Listen(name string) (*ChanListener, error) {
+	lc := ListenConfig{Network: n}
+	return lc.Listen(name)
+}
+
+// Dial connects to the listener called name on n, as DialChan does on the
+// default Network.
+func (n *Network) Dial(name string) (*ChanConn, error) {
+	creq := newConnect(n, name, "", nil)
+	return dial(context.Background(), name, creq, defaultDialDeadline(),
+		false)
+}
+
+// DialContext is like Dial, but gives up if ctx is done before the
+// connection is accepted, as DialChanContext does.
+func (n *Network) DialContext(ctx context.Context, name string) (*ChanConn, error) {
+	d := Dialer{Network: n}
+	return d.DialContext(ctx, name)
+}
+
+// ListListeners returns the names listened on in n, including aliases, in
+// sorted order.
+func (n *Network) ListListeners() []string {
+	n.mtx.Lock()
+	names := make([]string, 0, len(n.lst))
+	for name := range n.lst {
+		names = append(names, name)
+	}
+	n.mtx.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// exists reports whether a listener is registered as name.
+func (n *Network) exists(name string) bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	_, ok := n.lst[name]
+	return ok
 }
 
+// clientSeq numbers client connections, to give them distinct addresses.
+var clientSeq uint64
+
 // ChanAddr stores just the address, which will normally be something
-// like a path, but any valid string can be used as a key.  This implements
-// the net.Addr interface.
+// like a path, but any valid string can be used as a key.  An address may
+// also carry a numeric discriminator, much like a port number, in which
+// case it is formatted as "name:disc", so that code which expects to use
+// net.SplitHostPort on addresses works.  Client connections have such
+// addresses.  This implements the net.Addr interface.
 type ChanAddr struct {
-	name string
+	name    string
+	disc    int
+	hasDisc bool
+}
+
+// NewChanAddr returns an address made of name and the discriminator disc.
+func NewChanAddr(name string, disc int) *ChanAddr {
+	return &ChanAddr{name: name, disc: disc, hasDisc: true}
+}
+
+// ParseChanAddr parses an address as formatted by String.  If s ends with
+// a colon and a number, that is the discriminator, and the rest is the
+// name, which must not be empty.  Otherwise all of s is the name, as in
+// "host:http".  The colon of a scheme, as in "svc://billing", does not
+// count.
+func ParseChanAddr(s string) (*ChanAddr, error) {
+	if s == "" {
+		return nil, ErrInvalidAddr
+	}
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 || !isDigits(s[i+1:]) {
+		return &ChanAddr{name: s}, nil
+	}
+	disc, err := strconv.Atoi(s[i+1:])
+	if err != nil || i == 0 {
+		return nil, ErrInvalidAddr
+	}
+	return NewChanAddr(s[:i], disc), nil
+}
+
+// isDigits reports whether s is a non-empty string of decimal digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
 }
 
-// String returns the name of the end point -- the listen address.  This
-// is just an arbitrary string used as a lookup key.
+// String returns the name of the end point -- the listen address -- with
+// the discriminator, if there is one.  The name is just an arbitrary
+// string used as a lookup key.
 func (a *ChanAddr) String() string {
+	if a.hasDisc {
+		return a.name + ":" + strconv.Itoa(a.disc)
+	}
+	return a.name
+}
+
+// Name returns the name part of the address.
+func (a *ChanAddr) Name() string {
 	return a.name
 }
 
+// Disc returns the discriminator of the address, and whether it has one.
+func (a *ChanAddr) Disc() (int, bool) {
+	return a.disc, a.hasDisc
+}
+
 // Network returns "chan".
 func (a *ChanAddr) Network() string {
 	return "chan"
 }
 
+// Scheme returns the scheme of a name that looks like a URL, such as
+// "svc" for "svc://billing/v2", or "" if the name has none.  Names are
+// still only keys, so this, along with Service and Path, is merely a
+// convenience for code that routes on them.
+func (a *ChanAddr) Scheme() string {
+	scheme, _, _ := a.split()
+	return scheme
+}
+
+// Service returns the part of a name with a scheme that follows it, up
+// to the path, such as "billing" for "svc://billing/v2".
+func (a *ChanAddr) Service() string {
+	_, service, _ := a.split()
+	return service
+}
+
+// Path returns the rest of a name with a scheme, after the service, such
+// as "/v2" for "svc://billing/v2".
+func (a *ChanAddr) Path() string {
+	_, _, path := a.split()
+	return path
+}
+
+// split breaks a name of the form "scheme://service/path" into its parts,
+// which are all empty if it has no scheme.
+func (a *ChanAddr) split() (scheme, service, path string) {
+	i := strings.Index(a.name, "://")
+	if i <= 0 {
+		return "", "", ""
+	}
+	scheme, service = a.name[:i], a.name[i+3:]
+	if j := strings.IndexByte(service, '/'); j >= 0 {
+		service, path = service[:j], service[j:]
+	}
+	return scheme, service, path
+}
+
 // ChanConn represents a logical connection between two peers communication
 // using a pair of cross-connected go channels. This provides net.Conn
 // semantics on top of channels.
 type ChanConn struct {
+	// Counters, updated atomically, and first for 64-bit alignment.
+	nread     int64
+	nwritten  int64
+	nmsgs     int64
+	rbusy     int32 // Reads in progress, see Detach
+	wbusy     int32 // Sends in progress, see Detach
+	mtx       sync.Mutex
+	rmtx      sync.Mutex
+	wmtx      sync.RWMutex
+	rclosed   bool
+	wclosed   bool
 	fifo      chan []byte
 	fin       chan bool
+	wfin      chan struct{}
+	drained   chan struct{}
+	done      chan struct{}
 	rdeadline time.Time
 	wdeadline time.Time
+	rdlchg    chan struct{}
+	wdlchg    chan struct{}
 	peer      *ChanConn
 	pending   []byte
-	closed    bool
+	pendbuf   []byte
+	eof       bool
+	pool      *sync.Pool
+	rdbuf     int
+	rdrain    bool
+	rdstop    func() bool
+	msgmode   bool
+	maxmsg    int
+	split     bool
+	rdlimit   int64
+	idletmo   time.Duration
+	kaint     time.Duration
+	katmo     time.Duration
+	probe     chan struct{}
+	ack       chan struct{}
+	mirrors   []*ChanConn
 	addr      *ChanAddr
+	opened    time.Time
+	closed    time.Time
+	ctx       context.Context
+	ctxerr    error
+	reason    *string
+	detached  bool
+	tracked   bool
+	onDone    func()
+
+	// Write coalescing, see SetNoDelay
+	cmtx   sync.Mutex
+	delay  bool
+	wbuf   []byte
+	wtimer *time.Timer
+	werr   error
 }
 
 type chanConnect struct {
 	conn      *ChanConn
+	net       *Network
+	addr      *ChanAddr
+	meta      []byte
+	err       error
+	state     int32
 	connected chan bool
 }
 
+// The states of a chanConnect.
+const (
+	connectPending int32 = iota
+	connectClaimed
+	connectAbandoned
+)
+
 // ChanListener is used to listen to a socket.
 type ChanListener struct {
+	// Counters, updated atomically, and first for 64-bit alignment.
+	nrefused int64
+	nqfull   int64
+	ntimeout int64
+	mtx      sync.Mutex
 	name     string
 	connect  chan *chanConnect
 	deadline time.Time
+	closed   bool
+	moved    bool
+	aliases  []string
+	done     chan struct{}
+	cancel   chan struct{}
+	created  time.Time
+	accepted time.Time
+	depth    int
+	maxConns int
+	active   *int64 // Shared with the listeners it was rebound from
+	net      *Network
+
+	// OnAccept, if not nil, is called with each newly accepted
+	// connection, just before AcceptChan returns it.  This is useful
+	// for instrumentation, such as metrics or tracing.
+	OnAccept func(*ChanConn)
+
+	// AcceptFilter, if not nil, is called with the metadata of each
+	// dialed connection before anything is allocated for it.  If it
+	// returns an error, the connection is refused, the dialer fails with
+	// that error, and AcceptChan goes on to wait for the next one.
+	AcceptFilter func(meta []byte) error
+
+	// ReadTimeout and WriteTimeout, if not zero, set the read and write
+	// deadlines of each accepted connection to that long after it was
+	// accepted.  The deadlines may be changed on the connection as usual.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
 }
 
 // ListenChan establishes the server address and receiving
 // channel where clients can connect.  This service address is backed
-// by a go channel.
+// by a go channel.  If name is empty, a unique name is chosen, much like
+// binding to port 0 for TCP; use Addr to learn what it is.
 func ListenChan(name string) (*ChanListener, error) {
-	listeners.mtx.Lock()
-	defer listeners.mtx.Unlock()
+	var lc ListenConfig
+	return lc.Listen(name)
+}
+
+// ListenConfig contains options for listening, so that many listeners can
+// be created with the same configuration.  The zero value gives the same
+// listener as ListenChan.
+type ListenConfig struct {
+	// Backlog is how many dialed connections may wait to be accepted,
+	// before further dials fail with ErrListenQFull.  Zero means 64.
+	Backlog int
+
+	// BufferDepth is how many messages each accepted connection buffers
+	// in each direction.  Zero means 10.
+	BufferDepth int
 
-	if listeners.lst == nil {
-		listeners.lst = make(map[string]*ChanListener)
+	// MaxConns, if not zero, limits how many accepted connections may be
+	// open at once.  Dials beyond that are refused with ErrConnRefused
+	// when they come to be accepted.  A connection counts as open until
+	// it is closed, or its client has closed it.
+	MaxConns int
+
+	// ReadTimeout and WriteTimeout are the defaults for the fields of the
+	// same names in the listener.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Network is where to listen.  Nil means the default Network.
+	Network *Network
+}
+
+// Listen creates a listener for name, configured by lc, just as ListenChan
+// does.
+func (lc *ListenConfig) Listen(name string) (*ChanListener, error) {
+	n := lc.Network
+	if n == nil {
+		if n = defaultNetwork(); n == nil {
+			return nil, ErrNoRegistry
+		}
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if n.lst == nil {
+		n.lst = make(map[string]*ChanListener)
+	}
+	for name == "" {
+		n.seq++
+		name = fmt.Sprintf("ephemeral.%d", n.seq)
+		if _, ok := n.lst[name]; ok {
+			name = ""
+		}
 	}
-	if _, ok := listeners.lst[name]; ok {
+	if _, ok := n.lst[name]; ok {
 		return nil, ErrAddrInUse
 	}
 
 	listener := new(ChanListener)
 	listener.name = name
+	listener.net = n
 	// The listen backlog we support.. fairly arbitrary
-	listener.connect = make(chan *chanConnect, 64)
+	backlog := 64
+	if lc.Backlog > 0 {
+		backlog = lc.Backlog
+	}
+	listener.connect = make(chan *chanConnect, backlog)
+	// We support buffering up to 10 messages for efficiency
+	listener.depth = 10
+	if lc.BufferDepth > 0 {
+		listener.depth = lc.BufferDepth
+	}
+	listener.maxConns = lc.MaxConns
+	listener.active = new(int64)
+	listener.ReadTimeout = lc.ReadTimeout
+	listener.WriteTimeout = lc.WriteTimeout
+	listener.done = make(chan struct{})
+	listener.created = now()
 	// Register listener on the service point
-	listeners.lst[name] = listener
+	n.register(name, listener)
+	return listener, nil
+}
+
+// ListenChanContext is like ListenChan, but ties the lifetime of the
+// listener to ctx.  When ctx is done, the listener is closed, which
+// releases the name.
+func ListenChanContext(ctx context.Context, name string) (*ChanListener, error) {
+	listener, err := ListenChan(name)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-listener.done:
+		}
+	}()
 	return listener, nil
 }
 
 // AcceptChan accepts a client's connection request via Dial,
-// and returns the associated underlying connection.
+// and returns the associated underlying connection.  It may be called
+// from several goroutines at once, to share the work of accepting; each
+// dialed connection is accepted by exactly one of them.
 func (listener *ChanListener) AcceptChan() (*ChanConn, error) {
+	conn, _, err := listener.AcceptChanMeta()
+	return conn, err
+}
 
-	deadline := mkTimer(listener.deadline)
+// AcceptN accepts n connections, and returns them.  If accepting fails
+// first, for instance because the deadline set by SetDeadline expires, it
+// stops, and returns the connections it did accept along with the error.
+// This saves writing the loop in tests and servers that expect a known
+// number of clients.
+func (listener *ChanListener) AcceptN(n int) ([]*ChanConn, error) {
+	conns := make([]*ChanConn, 0, n)
+	for len(conns) < n {
+		conn, err := listener.AcceptChan()
+		if err != nil {
+			return conns, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
 
-	select {
-	case connect := <-listener.connect:
-		// Make a pair of channels, and twist them.  We keep
-		// the first pair, client gets the twisted pair.
-		// We support buffering up to 10 messages for efficiency
-		chan1 := make(chan []byte, 10)
-		chan2 := make(chan []byte, 10)
-		fin1 := make(chan bool)
-		fin2 := make(chan bool)
-		addr := &ChanAddr{name: listener.name}
-		server := &ChanConn{fifo: chan1, fin: fin1, addr: addr}
-		client := &ChanConn{fifo: chan2, fin: fin2, addr: addr}
-		server.peer = client
-		client.peer = server
-		// And send the client its info, and a wakeup
-		connect.conn = client
-		connect.connected <- true
-		return server, nil
-
-	case <-deadline:
-		// NB: its never possible to read from a nil channel.
-		// So this only counts if we have a timer running.
-		return nil, ErrAcceptTimeout
+// Serve accepts connections, and calls handler for each one in a new
+// goroutine, until the listener is closed, when it returns nil.  If
+// accepting fails for any other reason, such as the deadline expiring,
+// that error is returned.  Serve does not wait for handlers to finish.
+func (listener *ChanListener) Serve(handler func(*ChanConn)) error {
+	for {
+		conn, err := listener.AcceptChan()
+		if err == ErrListenerClosed {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go handler(conn)
 	}
 }
 
-// Accept is a generic way to accept a connection.
-func (listener *ChanListener) Accept() (net.Conn, error) {
-	c, err := listener.AcceptChan()
-	return c, err
+// AcceptChanMeta is like AcceptChan, but also returns the metadata that
+// the client supplied to DialChanMeta, which is nil if there was none.
+func (listener *ChanListener) AcceptChanMeta() (*ChanConn, []byte, error) {
+	return listener.AcceptChanCheck(nil)
 }
 
-// DialChan is the client side, think connect().
-func DialChan(name string) (*ChanConn, error) {
-	var listener *ChanListener
-	listeners.mtx.Lock()
-	if listeners.lst != nil {
-		listener = listeners.lst[name]
-	}
-	listeners.mtx.Unlock()
-	if listener == nil {
-		return nil, ErrConnRefused
-	}
-
-	// TBD: This deadline is rather arbitrary
-	deadline := time.After(time.Second * 10)
-	creq := &chanConnect{conn: nil}
-	creq.connected = make(chan bool)
-
-	// Note: We assume the buffering is sufficient.  If the server
-	// side cannot keep up with connect requests, then we'll fail.  The
-	// connect is "non-blocking" in this regard.  As there is a reasonable
-	// listen backlog, this should only happen if lots of clients try to
-	// connect too fast.  In TCP world if this happens it becomes
-	// ECONNREFUSED.  We use ErrListenQFull.
-	select {
-	case listener.connect <- creq:
+// AcceptChanCheck is like AcceptChanMeta, but first passes the client's
+// metadata to check, if it is not nil.  If check returns an error, the
+// connection is rejected, and the same error is returned both here and to
+// the client from DialChan.  This lets the server refuse a connection for
+// application reasons, such as an unsupported protocol version.
+func (listener *ChanListener) AcceptChanCheck(check func(meta []byte) error) (*ChanConn, []byte, error) {
+	return listener.accept(context.Background(), check)
+}
 
-	default:
-		return nil, ErrListenQFull
+// AcceptContext is like AcceptChan, but gives up if ctx is done first.  The
+// connection is attached to ctx, as by WithContext, so that it is closed
+// when ctx is done.
+func (listener *ChanListener) AcceptContext(ctx context.Context) (*ChanConn, error) {
+	conn, _, err := listener.accept(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return conn.WithContext(ctx), nil
+}
+
+// accept does the work of accepting for all the variants.
+func (listener *ChanListener) accept(ctx context.Context, check func(meta []byte) error) (*ChanConn, []byte, error) {
+
+	listener.mtx.Lock()
+	closed := listener.closed
+	deadline, stop := mkTimer(listener.deadline)
+	if listener.cancel == nil {
+		listener.cancel = make(chan struct{})
 	}
+	cancel := listener.cancel
+	listener.mtx.Unlock()
+	defer stop()
 
-	select {
-	case _, ok := <-creq.connected:
-		if !ok {
-			return nil, ErrConnClosed
-		}
+	if closed {
+		return nil, nil, ErrListenerClosed
+	}
+
+	for {
+		select {
+		case connect, ok := <-listener.connect:
+			if !ok {
+				// Nothing more can ever arrive.
+				return nil, nil, ErrListenerClosed
+			}
+			if !connect.claim() {
+				// The dialer gave up waiting, try the next.
+				continue
+			}
+			if listener.AcceptFilter != nil {
+				if err := listener.AcceptFilter(connect.meta); err != nil {
+					atomic.AddInt64(&listener.nrefused, 1)
+					connect.err = err
+					close(connect.connected)
+					continue
+				}
+			}
+			if check != nil {
+				if err := check(connect.meta); err != nil {
+					atomic.AddInt64(&listener.nrefused, 1)
+					connect.err = err
+					close(connect.connected)
+					return nil, connect.meta, err
+				}
+			}
+			if !listener.acquire() {
+				atomic.AddInt64(&listener.nrefused, 1)
+				connect.err = ErrConnRefused
+				close(connect.connected)
+				continue
+			}
+			addr := &ChanAddr{name: listener.name}
+			server, client := newConnPair(addr, connect.addr,
+				listener.depth)
+			server.onDone = listener.release
+			// And send the client its info, and a wakeup
+			connect.conn = client
+			connect.connected <- true
+			at := now()
+			listener.mtx.Lock()
+			listener.accepted = at
+			listener.mtx.Unlock()
+			if listener.ReadTimeout > 0 {
+				server.SetReadDeadline(at.Add(listener.ReadTimeout))
+			}
+			if listener.WriteTimeout > 0 {
+				server.SetWriteDeadline(at.Add(listener.WriteTimeout))
+			}
+			if listener.OnAccept != nil {
+				listener.OnAccept(server)
+			}
+			return server, connect.meta, nil
+
+		case <-listener.done:
+			return nil, nil, ErrListenerClosed
+
+		case <-ctx.Done():
+			err := contextError(ctx, ErrAcceptTimeout)
+			if err == ErrAcceptTimeout {
+				atomic.AddInt64(&listener.ntimeout, 1)
+			}
+			return nil, nil, err
+
+		case <-cancel:
+			return nil, nil, ErrAcceptCancelled
 
-	case <-deadline:
-		return nil, ErrConnTimeout
+		case <-deadline:
+			// NB: its never possible to read from a nil channel.
+			// So this only counts if we have a timer running.
+			atomic.AddInt64(&listener.ntimeout, 1)
+			return nil, nil, ErrAcceptTimeout
+		}
 	}
+}
 
-	return creq.conn, nil
+// Close stops listening, and releases the name for reuse.  Any blocked
+// AcceptChan calls return ErrListenerClosed, and dialers still waiting to
+// be accepted fail with ErrConnClosed.
+func (listener *ChanListener) Close() error {
+	listener.mtx.Lock()
+	moved := listener.moved
+	names := append([]string{listener.name}, listener.aliases...)
+	listener.mtx.Unlock()
+	n := listener.net
+	n.mtx.Lock()
+	for _, name := range names {
+		if n.lst[name] == listener {
+			delete(n.lst, name)
+		}
+	}
+	n.mtx.Unlock()
+	listener.shutdown()
+	if moved {
+		// The queue belongs to the replacement now.
+		return nil
+	}
+	return listener.Reject()
 }
 
-// Close implements the io.Closer interface.  It closes the channel for
-// communications.  Messages that have already been sent may be received
-// by the peer before the peer closes its side of the connection.  A
-// notification is sent to the peer so it will close its side as well.
-func (conn *ChanConn) Close() error {
-	conn.CloseRead()
-	conn.CloseWrite()
+// AddAlias registers name as another address for the listener, so that
+// dialing it reaches the same listener as its own name does.  This fails
+// with ErrAddrInUse if the name is taken.  The alias is released when the
+// listener is closed.
+func (listener *ChanListener) AddAlias(name string) error {
+	n := listener.net
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+	if listener.closed {
+		return ErrListenerClosed
+	}
+	if _, ok := n.lst[name]; ok {
+		return ErrAddrInUse
+	}
+	n.register(name, listener)
+	listener.aliases = append(listener.aliases, name)
 	return nil
 }
 
-// CloseRead closes the read side of the connection.  Addtionally, a
-// notification is sent to the peer, to begin an orderly shutdown of the
-// connection.  No further data may be read from the connection.
-func (conn *ChanConn) CloseRead() error {
-	close(conn.fin)
-	conn.closed = true
-	return nil
+// Rebind replaces the listener with a new one, bound to the same name,
+// which takes over any dialed connections waiting to be accepted.  The
+// name stays registered throughout, so dialers are never refused, as
+// they would be if the listener were closed and opened again.  This is
+// useful for handing over to a new handler during a reload.  The old
+// listener is closed: blocked AcceptChan calls on it return
+// ErrListenerClosed (though one that was already completing may still
+// take a connection).  The configuration from ListenConfig is kept,
+// including MaxConns, which goes on counting the connections the old
+// listener accepted, but settings such as the deadline and OnAccept are
+// not carried over.
+func (listener *ChanListener) Rebind() (*ChanListener, error) {
+	n := listener.net
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	listener.mtx.Lock()
+	if listener.closed {
+		listener.mtx.Unlock()
+		return nil, ErrListenerClosed
+	}
+	listener.moved = true
+	listener.mtx.Unlock()
+
+	repl := new(ChanListener)
+	repl.name = listener.name
+	repl.aliases = listener.aliases
+	repl.connect = listener.connect
+	repl.depth = listener.depth
+	repl.maxConns = listener.maxConns
+	repl.active = listener.active
+	repl.ReadTimeout = listener.ReadTimeout
+	repl.WriteTimeout = listener.WriteTimeout
+	repl.net = n
+	repl.done = make(chan struct{})
+	repl.created = now()
+	n.lst[repl.name] = repl
+	for _, name := range repl.aliases {
+		n.lst[name] = repl
+	}
+	listener.shutdown()
+	return repl, nil
 }
 
-// CloseWrite closes the write side of the channel.  After this point, it
-// is illegal to write data on the connection.
-func (conn *ChanConn) CloseWrite() error {
-	close(conn.fifo)
-	return nil
+// Reject refuses every dialed connection that is waiting to be accepted.
+// The dialers fail immediately with ErrConnClosed, rather than waiting
+// for their connect timeout.  The listener itself remains open.
+func (listener *ChanListener) Reject() error {
+	for {
+		select {
+		case connect, ok := <-listener.connect:
+			if !ok {
+				return nil
+			}
+			if connect.claim() {
+				atomic.AddInt64(&listener.nrefused, 1)
+				close(connect.connected)
+			}
+		default:
+			return nil
+		}
+	}
 }
 
-// LocalAddr returns the local address.  For now, both client and server
-// use the same address, which is the key used for Listen or Dial.
-func (conn *ChanConn) LocalAddr() net.Addr {
-	return conn.addr
+// shutdown marks the listener closed, and wakes any blocked acceptors.
+func (listener *ChanListener) shutdown() {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+	if !listener.closed {
+		listener.closed = true
+		close(listener.done)
+	}
 }
 
-// RemoteAddr returns the peer's address.  For now, both client and server
-// use the same address, which is the key used for Listen or Dial.
-func (conn *ChanConn) RemoteAddr() net.Addr {
-	return conn.peer.addr
+// acquire counts a new connection against MaxConns, failing if there are
+// already as many open as allowed.
+func (listener *ChanListener) acquire() bool {
+	for {
+		n := atomic.LoadInt64(listener.active)
+		if listener.maxConns > 0 && n >= int64(listener.maxConns) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(listener.active, n, n+1) {
+			return true
+		}
+	}
 }
 
-// SetDeadline sets the timeout for both read and write.
-func (conn *ChanConn) SetDeadline(t time.Time) error {
-	conn.rdeadline = t
-	conn.wdeadline = t
-	return nil
+// release counts a connection as no longer open.
+func (listener *ChanListener) release() {
+	atomic.AddInt64(listener.active, -1)
 }
 
-// SetReadDeadline sets the timeout for read (receive).
-func (conn *ChanConn) SetReadDeadline(t time.Time) error {
-	conn.rdeadline = t
-	return nil
+// ListenerStats is a snapshot of the activity on a listener.
+type ListenerStats struct {
+	CreatedAt      time.Time // When the listener was created
+	LastAcceptAt   time.Time // When a connection was last accepted, if ever
+	Refused        int64     // Dials refused by a filter, MaxConns, or close
+	QueueFull      int64     // Dials failed with ErrListenQFull
+	AcceptTimeouts int64     // Accepts failed with ErrAcceptTimeout
 }
 
-// SetWriteDeadline sets the timeout for write (send).
-func (conn *ChanConn) SetWriteDeadline(t time.Time) error {
-	conn.wdeadline = t
+// Stats returns a snapshot of the listener's activity.  This can be used,
+// for instance, to find and close listeners that have been idle for long,
+// or, if QueueFull keeps growing, to tell when the backlog is too small.
+func (listener *ChanListener) Stats() ListenerStats {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+	return ListenerStats{
+		CreatedAt:      listener.created,
+		LastAcceptAt:   listener.accepted,
+		Refused:        atomic.LoadInt64(&listener.nrefused),
+		QueueFull:      atomic.LoadInt64(&listener.nqfull),
+		AcceptTimeouts: atomic.LoadInt64(&listener.ntimeout),
+	}
+}
+
+// Cancel makes any AcceptChan calls that are blocked return
+// ErrAcceptCancelled at once.  Unlike Close, the listener is left open,
+// and later calls to AcceptChan work as usual, so this can be used to
+// pause an accept loop.
+func (listener *ChanListener) Cancel() {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+	if listener.cancel != nil {
+		close(listener.cancel)
+		listener.cancel = nil
+	}
+}
+
+// SetDeadline sets the deadline for AcceptChan, which will fail with
+// ErrAcceptTimeout if no connection arrives in time.  A zero value
+// means Accept waits indefinitely.
+func (listener *ChanListener) SetDeadline(t time.Time) error {
+	listener.mtx.Lock()
+	listener.deadline = t
+	listener.mtx.Unlock()
 	return nil
 }
 
-// Read implements the io.Reader interface.
-func (conn *ChanConn) Read(b []byte) (int, error) {
-	b = b[0:0] // empty slice
-	for len(b) < cap(b) {
+// QueueLen returns the number of dialed connections waiting to be
+// accepted.  Once this reaches QueueCap, DialChan fails with
+// ErrListenQFull.
+func (listener *ChanListener) QueueLen() int {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+	return len(listener.connect)
+}
 
-		// get a byte slice from our peer if we don't have one yet
-		if conn.pending == nil || len(conn.pending) == 0 {
-			if len(b) > 0 {
-				return len(b), nil
-			}
-			timer := mkTimer(conn.rdeadline)
-			select {
-			case msg := <-conn.peer.fifo:
-				if msg != nil {
-					conn.pending = msg
-				} else if len(b) > 0 {
-					return len(b), nil
-				} else {
-					return 0, io.EOF
-				}
+// ActiveConns returns the number of accepted connections that are still
+// open, which is what MaxConns limits.  After Rebind, this includes those
+// accepted by the listener that was replaced.
+func (listener *ChanListener) ActiveConns() int {
+	return int(atomic.LoadInt64(listener.active))
+}
 
-			case <-timer:
-				// Timeout
-				return len(b), ErrRdTimeout
-			}
-		}
+// QueueCap returns the size of the listen backlog.
+func (listener *ChanListener) QueueCap() int {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+	return cap(listener.connect)
+}
 
-		if conn.closed {
-			return len(b), io.EOF
-		}
-		want := cap(b) - len(b)
-		if want > len(conn.pending) {
-			want = len(conn.pending)
-		}
-		b = append(b, conn.pending[:want]...)
-		conn.pending = conn.pending[want:]
+// ListListeners returns the names that are currently being listened on,
+// including aliases, in sorted order.  This is intended for debugging and
+// administrative use, such as showing the services running in a process.
+// Only the default Network is listed, and nothing once it is disabled.
+func ListListeners() []string {
+	n := defaultNetwork()
+	if n == nil {
+		return nil
 	}
-	return len(b), nil
+	return n.ListListeners()
 }
 
-// Write implements the io.Writer interface.
-func (conn *ChanConn) Write(b []byte) (int, error) {
-	// Unlike Read, Write is quite a bit simpler, since
-	// we don't have to deal with buffers.  We just write to the
-	// channel/fifo.  We do have to respect when the peer has notified
-	// us that its side is closed, however.
+// ResetRegistry closes every registered listener, and empties the registry
+// so that all names may be reused.  This is chiefly intended to isolate
+// tests from one another, e.g. from TestMain.
+func ResetRegistry() {
+	defaultNet.mtx.Lock()
+	lst := defaultNet.lst
+	defaultNet.lst = make(map[string]*ChanListener)
+	defaultNet.mtx.Unlock()
 
-	// We have to make a copy to ensure that once a message is sent to
-	// us, we are insulated against later modification by the sender.
-	// Later we should consider limiting the size of this array to
-	// prevent someone from trying to send ridiculous message sizes all
-	// at once.  (E.g. avoid trying to alloc and copy 100 megabytes here!)
-	a := make([]byte, len(b))
-	copy(a, b)
-	b = a
+	for _, listener := range lst {
+		listener.shutdown()
+		listener.Reject()
+	}
+}
 
-	deadline := mkTimer(conn.wdeadline)
-	n := len(b)
+// newConnPair makes a pair of connections, using a pair of channels that
+// are twisted, so that each reads what the other writes.  Each channel
+// buffers up to depth messages.
+func newConnPair(addr1, addr2 *ChanAddr, depth int) (*ChanConn, *ChanConn) {
+	conn1 := &ChanConn{fifo: make(chan []byte, depth), fin: make(chan bool),
+		addr: addr1}
+	conn2 := &ChanConn{fifo: make(chan []byte, depth), fin: make(chan bool),
+		addr: addr2}
+	conn1.drained = make(chan struct{}, 1)
+	conn2.drained = make(chan struct{}, 1)
+	conn1.wfin = make(chan struct{})
+	conn2.wfin = make(chan struct{})
+	conn1.probe = make(chan struct{}, 1)
+	conn2.probe = make(chan struct{}, 1)
+	conn1.ack = make(chan struct{}, 1)
+	conn2.ack = make(chan struct{}, 1)
+	conn1.peer = conn2
+	conn2.peer = conn1
+	conn1.opened = now()
+	conn2.opened = conn1.opened
+	track(conn1, conn2)
+	return conn1, conn2
+}
 
-	select {
-	case <-conn.peer.fin:
-		// Remote close
-		return n, ErrConnClosed
+// PipeChan creates a pair of connected connections, without involving a
+// listener, similar to net.Pipe.  Unlike net.Pipe, writes are buffered.
+func PipeChan() (*ChanConn, *ChanConn) {
+	addr := &ChanAddr{name: "pipe"}
+	return newConnPair(addr, addr, 10)
+}
 
-	case conn.fifo <- b:
-		// Sent it
-		return n, nil
+// PipeChanSync is like PipeChan, but the connections are unbuffered, so
+// that each Write returns only once the peer has received the data.  This
+// rendezvous makes backpressure deterministic, which is useful in tests.
+// Beware that if both sides Write at the same time, without another
+// goroutine reading, they deadlock (unless there is a write deadline).
+func PipeChanSync() (*ChanConn, *ChanConn) {
+	addr := &ChanAddr{name: "pipe"}
+	return newConnPair(addr, addr, 0)
+}
+
+// Addr returns the address the listener is bound to.
+func (listener *ChanListener) Addr() net.Addr {
+	return &ChanAddr{name: listener.name}
+}
 
-	case <-deadline:
-		// Timeout
-		return n, ErrWrTimeout
+// Accept is a generic way to accept a connection.
+func (listener *ChanListener) Accept() (net.Conn, error) {
+	c, err := listener.AcceptChan()
+	if err != nil {
+		// Avoid returning a non-nil interface holding a nil pointer.
+		return nil, err
 	}
+	return c, nil
 }
 
-// ReaderFrom, WriterTo interfaces can give some better performance,
-// but we skip that for now, they're optional interfaces
-// TO Add  Read, Write, (CloseRead, CloseWrite)
-// ReadFrom, WriteTo,
-func mkTimer(deadline time.Time) <-chan time.Time {
+// DialChan is the client side, think connect().
+func DialChan(name string) (*ChanConn, error) {
+	return DialChanMeta(name, nil)
+}
 
-	if deadline.IsZero() {
-		return nil
+// DialChanMeta is like DialChan, but passes a small metadata payload,
+// such as a protocol version or token, to the server.  The server
+// receives it from AcceptChanMeta, which saves a round trip for simple
+// negotiation.
+func DialChanMeta(name string, meta []byte) (*ChanConn, error) {
+	creq := newConnect(defaultNetwork(), name, "", meta)
+	return dial(context.Background(), name, creq, defaultDialDeadline(),
+		false)
+}
+
+// DialChanFrom is like DialChan, but uses local as the address of the
+// client, which the server sees as the RemoteAddr of the connection.  This
+// lets a client identify itself, for instance by a tenant ID, to a server
+// applying access controls.  If local is empty, an address is made up, as
+// for DialChan.
+func DialChanFrom(local, name string) (*ChanConn, error) {
+	creq := newConnect(defaultNetwork(), name, local, nil)
+	return dial(context.Background(), name, creq, defaultDialDeadline(),
+		false)
+}
+
+// DialChanContext is like DialChan, but gives up if ctx is done before
+// the connection is accepted.  The default dial timeout does not apply.
+func DialChanContext(ctx context.Context, name string) (*ChanConn, error) {
+	var d Dialer
+	return d.DialContext(ctx, name)
+}
+
+// DialChanWait is like DialChanContext, but if nothing is listening on
+// name yet, it waits for a listener to be registered, rather than failing
+// with ErrConnRefused.  This avoids races at startup, when clients may
+// dial before their server is listening.  If ctx expires first, it fails
+// with ErrConnTimeout.  A listener that is registered, but refuses the
+// connection, still fails it with ErrConnRefused.
+func DialChanWait(ctx context.Context, name string) (*ChanConn, error) {
+	n := defaultNetwork()
+	if n == nil {
+		return nil, ErrNoRegistry
+	}
+	return n.DialWait(ctx, name)
+}
+
+// DialWait is like DialContext, but waits for a listener to be registered
+// as name on n, as DialChanWait does on the default Network.
+func (n *Network) DialWait(ctx context.Context, name string) (*ChanConn, error) {
+	for {
+		n.mtx.Lock()
+		if n.registered == nil {
+			n.registered = make(chan struct{})
+		}
+		registered := n.registered
+		_, ok := n.lst[name]
+		n.mtx.Unlock()
+
+		if ok {
+			conn, err := n.DialContext(ctx, name)
+			if err != ErrConnRefused || n.exists(name) {
+				return conn, err
+			}
+			// Closed just as we dialed, so wait for another.
+		}
+		select {
+		case <-registered:
+		case <-ctx.Done():
+			return nil, contextError(ctx, ErrConnTimeout)
+		}
+	}
+}
+
+// Dialer contains options for connecting to a listener.  The zero value
+// behaves like DialChanContext.
+type Dialer struct {
+	// Timeout is the longest a dial may wait, in addition to any
+	// deadline on its context.  Zero means no limit.
+	Timeout time.Duration
+
+	// WaitForBacklog makes a dial to a listener whose backlog is full
+	// wait for space, rather than failing at once with ErrListenQFull.
+	// If no space is made in time, it still fails with ErrListenQFull,
+	// which distinguishes this from ErrConnTimeout, where the request was
+	// queued, but not accepted in time.
+	WaitForBacklog bool
+
+	// MaxQFullRetries is how many more times a dial to a listener whose
+	// backlog is full tries again, after waiting RetryDelay, before it
+	// fails with ErrListenQFull.  This smooths over brief bursts of
+	// dialing without waiting indefinitely, as WaitForBacklog would.
+	// Zero, the default, means no retries.
+	MaxQFullRetries int
+
+	// RetryDelay is how long to wait before each retry.  Zero means a
+	// millisecond.
+	RetryDelay time.Duration
+
+	// Network is where to look for the listener.  Nil means the default
+	// Network.
+	Network *Network
+}
+
+// DialContext connects to the listener called name, using the options
+// in the Dialer.  It gives up if ctx is done before the connection is
+// accepted.
+func (d *Dialer) DialContext(ctx context.Context, name string) (*ChanConn, error) {
+	var deadline time.Time
+	if d.Timeout != 0 {
+		deadline = now().Add(d.Timeout)
+	}
+	n := d.Network
+	if n == nil {
+		n = defaultNetwork()
+	}
+	creq := newConnect(n, name, "", nil)
+	for retries := 0; ; retries++ {
+		conn, err := dial(ctx, name, creq, deadline, d.WaitForBacklog)
+		if err != ErrListenQFull || retries >= d.MaxQFullRetries {
+			return conn, err
+		}
+		if err := d.retryWait(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryWait waits for RetryDelay before a retry, or fails if ctx is done
+// first.  The request was never queued, so it may simply be sent again.
+func (d *Dialer) retryWait(ctx context.Context) error {
+	delay := d.RetryDelay
+	if delay <= 0 {
+		delay = time.Millisecond
+	}
+	timer, stop := mkTimer(now().Add(delay))
+	defer stop()
+	select {
+	case <-timer:
+		return nil
+	case <-ctx.Done():
+		return contextError(ctx, ErrListenQFull)
+	}
+}
+
+// dial does the work of dialing for all the variants, sending creq to the
+// listener called name, and reports the outcome to the dial hook.
+func dial(ctx context.Context, name string, creq *chanConnect,
+	deadline time.Time, wait bool) (*ChanConn, error) {
+
+	dialHook.mtx.Lock()
+	hook := dialHook.fn
+	dialHook.mtx.Unlock()
+	if hook == nil {
+		return dialConn(ctx, name, creq, deadline, wait)
+	}
+	start := now()
+	conn, err := dialConn(ctx, name, creq, deadline, wait)
+	hook(name, now().Sub(start), err)
+	return conn, err
+}
+
+// dialConn sends creq to the listener called name, and waits for it to be
+// accepted.
+func dialConn(ctx context.Context, name string, creq *chanConnect,
+	deadline time.Time, wait bool) (*ChanConn, error) {
+
+	timer, stop := mkTimer(deadline)
+	defer stop()
+	err := enqueueConnect(ctx, name, creq, timer, wait)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-creq.connected:
+	case <-timer:
+		err = ErrConnTimeout
+	case <-ctx.Done():
+		err = contextError(ctx, ErrConnTimeout)
+	}
+	if err != nil {
+		if creq.abandon() {
+			return nil, err
+		}
+		// An acceptor claimed us just in time.
+		<-creq.connected
+	}
+	return creq.result()
+}
+
+// contextError returns the error for an operation stopped by ctx, which
+// is tmo if ctx's deadline passed.
+func contextError(ctx context.Context, tmo error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return tmo
+	}
+	return ctx.Err()
+}
+
+// dialTimeout holds the connect timeout used by DialChan.
+var dialTimeout = struct {
+	mtx     sync.Mutex
+	timeout time.Duration
+}{timeout: 10 * time.Second}
+
+// SetDefaultDialTimeout sets how long DialChan and DialChanMeta wait for
+// the server to accept a connection before failing with ErrConnTimeout.
+// The initial default is 10 seconds.  Zero means wait indefinitely.
+func SetDefaultDialTimeout(d time.Duration) {
+	dialTimeout.mtx.Lock()
+	dialTimeout.timeout = d
+	dialTimeout.mtx.Unlock()
+}
+
+// dialHook holds the function set by SetDialHook.
+var dialHook struct {
+	mtx sync.Mutex
+	fn  func(name string, d time.Duration, err error)
+}
+
+// SetDialHook arranges for fn to be called each time a dial completes,
+// with the name dialed, how long it took until the connection was accepted
+// or the dial failed, and the error, if any.  This makes it easy to
+// collect connection latency, such as in a histogram, without wrapping
+// every dial.  Each attempt made by a Dialer with MaxQFullRetries is
+// reported separately.  TryDialChan is not reported.  A nil fn, the
+// default, removes the hook.
+func SetDialHook(fn func(name string, d time.Duration, err error)) {
+	dialHook.mtx.Lock()
+	dialHook.fn = fn
+	dialHook.mtx.Unlock()
+}
+
+// defaultDialDeadline returns the deadline for a dial starting now, which
+// is zero if there is no timeout.
+func defaultDialDeadline() time.Time {
+	dialTimeout.mtx.Lock()
+	d := dialTimeout.timeout
+	dialTimeout.mtx.Unlock()
+	if d == 0 {
+		return time.Time{}
+	}
+	return now().Add(d)
+}
+
+// TryDialChan is like DialChan, but never waits.  It fails immediately
+// with ErrConnRefused or ErrListenQFull, as DialChan does, but if the
+// connection request would have to wait for the server to accept it, the
+// request is withdrawn and TryDialChan fails with ErrWouldBlock.
+func TryDialChan(name string) (*ChanConn, error) {
+	creq := newConnect(defaultNetwork(), name, "", nil)
+	err := enqueueConnect(context.Background(), name, creq, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-creq.connected:
+		return creq.result()
+	default:
+	}
+	if creq.abandon() {
+		return nil, ErrWouldBlock
+	}
+	<-creq.connected
+	return creq.result()
+}
+
+// newConnect makes a request to connect to the listener called name on n,
+// from the address local, or a made up one if that is empty.  A nil n
+// means the default Network is disabled.
+func newConnect(n *Network, name, local string, meta []byte) *chanConnect {
+	creq := &chanConnect{conn: nil, net: n}
+	if local != "" {
+		creq.addr = &ChanAddr{name: local}
+	} else {
+		seq := atomic.AddUint64(&clientSeq, 1)
+		creq.addr = NewChanAddr(name, int(seq))
+	}
+	if meta != nil {
+		creq.meta = make([]byte, len(meta))
+		copy(creq.meta, meta)
+	}
+	// Buffered, so that the acceptor never waits for the dialer.
+	creq.connected = make(chan bool, 1)
+	return creq
+}
+
+// enqueueConnect queues a connection request on the listener called name,
+// on the Network of creq.  If wait is set, and the backlog is full, it
+// waits for space until timer fires or ctx is done.
+func enqueueConnect(ctx context.Context, name string, creq *chanConnect,
+	timer <-chan time.Time, wait bool) error {
+
+	n := creq.net
+	if n == nil {
+		return ErrNoRegistry
+	}
+	for {
+		n.mtx.Lock()
+		listener := n.lst[name]
+		n.mtx.Unlock()
+		if listener == nil {
+			return ErrConnRefused
+		}
+
+		// The listener may have been closed since we looked it up.
+		// Enqueueing under its lock means that Close, which rejects
+		// the queue after marking it closed, cannot miss us.
+		listener.mtx.Lock()
+		if listener.closed {
+			moved := listener.moved
+			listener.mtx.Unlock()
+			if moved {
+				// Rebound, so look up the replacement.
+				continue
+			}
+			atomic.AddInt64(&listener.nrefused, 1)
+			return ErrConnRefused
+		}
+		if listener.connect == nil {
+			// Not made by Listen, so nothing would ever accept,
+			// and waiting for room would block forever.
+			listener.mtx.Unlock()
+			atomic.AddInt64(&listener.nrefused, 1)
+			return ErrConnRefused
+		}
+
+		// Note: We assume the buffering is sufficient.  If the server
+		// side cannot keep up with connect requests, then we'll fail.
+		// The connect is "non-blocking" in this regard.  As there is a
+		// reasonable listen backlog, this should only happen if lots of
+		// clients try to connect too fast.  In TCP world if this happens
+		// it becomes ECONNREFUSED.  We use ErrListenQFull.
+		select {
+		case listener.connect <- creq:
+			listener.mtx.Unlock()
+			return nil
+		default:
+		}
+		listener.mtx.Unlock()
+		if !wait {
+			atomic.AddInt64(&listener.nqfull, 1)
+			return ErrListenQFull
+		}
+
+		select {
+		case listener.connect <- creq:
+		case <-listener.done:
+			// Closed or rebound, so look again.
+			continue
+		case <-timer:
+			atomic.AddInt64(&listener.nqfull, 1)
+			return ErrListenQFull
+		case <-ctx.Done():
+			err := contextError(ctx, ErrListenQFull)
+			if err == ErrListenQFull {
+				atomic.AddInt64(&listener.nqfull, 1)
+			}
+			return err
+		}
+
+		// We did not hold the lock, so the listener may have been
+		// closed, and its queue rejected, just before we got in.  Then
+		// nobody would ever take the request.
+		listener.mtx.Lock()
+		orphaned := listener.closed && !listener.moved
+		listener.mtx.Unlock()
+		if orphaned && creq.abandon() {
+			atomic.AddInt64(&listener.nrefused, 1)
+			return ErrConnRefused
+		}
+		return nil
+	}
+}
+
+// claim marks the request as being handled by an acceptor.  It fails if
+// the dialer has already given up on it.
+func (creq *chanConnect) claim() bool {
+	return atomic.CompareAndSwapInt32(&creq.state, connectPending,
+		connectClaimed)
+}
+
+// abandon withdraws the request, so that no acceptor will take it.  It
+// fails if an acceptor has already claimed it, in which case the outcome
+// will shortly be delivered on connected.
+func (creq *chanConnect) abandon() bool {
+	return atomic.CompareAndSwapInt32(&creq.state, connectPending,
+		connectAbandoned)
+}
+
+// result returns the outcome of a request once connected has fired.
+func (creq *chanConnect) result() (*ChanConn, error) {
+	if creq.conn != nil {
+		return creq.conn, nil
+	}
+	if creq.err != nil {
+		return nil, creq.err
+	}
+	return nil, ErrConnClosed
+}
+
+// Close implements the io.Closer interface.  It closes the channel for
+// communications.  Messages that have already been sent may be received
+// by the peer before the peer closes its side of the connection.  A
+// notification is sent to the peer so it will close its side as well.
+// The error, if any, is that from sending coalesced writes, as for
+// CloseWrite; the connection is closed regardless.
+func (conn *ChanConn) Close() error {
+	conn.CloseRead()
+	err := conn.CloseWrite()
+	conn.mtx.Lock()
+	if conn.closed.IsZero() {
+		conn.closed = now()
+	}
+	conn.mtx.Unlock()
+	return err
+}
+
+// CloseWithReason closes the connection, like Close, and records reason
+// for the peer, which can get it with CloseReason, once it sees EOF.  This
+// helps to tell why a connection ended.
+func (conn *ChanConn) CloseWithReason(reason string) error {
+	conn.mtx.Lock()
+	if !conn.wclosed {
+		conn.reason = &reason
+	}
+	conn.mtx.Unlock()
+	return conn.Close()
+}
+
+// CloseReason returns the reason the peer gave to CloseWithReason, and
+// whether it gave one.  It is only set once the peer has closed, so it is
+// best called after Read has returned io.EOF.
+func (conn *ChanConn) CloseReason() (string, bool) {
+	if conn.peer == nil {
+		return "", false
+	}
+	conn.peer.mtx.Lock()
+	defer conn.peer.mtx.Unlock()
+	if conn.peer.reason == nil || !conn.peer.wclosed {
+		return "", false
+	}
+	return *conn.peer.reason, true
+}
+
+// WithContext attaches ctx to the connection, and returns the connection.
+// When ctx is done, the connection is closed, and Read and Write, including
+// those already in progress, fail with ctx.Err().  This ties the lifetime
+// of a connection to that of a request, and lets its values travel with
+// the connection; see Context.
+func (conn *ChanConn) WithContext(ctx context.Context) *ChanConn {
+	conn.mtx.Lock()
+	conn.ctx = ctx
+	conn.mtx.Unlock()
+	if ctx.Done() == nil {
+		// Never cancelled, so there is nothing to watch for.
+		return conn
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.mtx.Lock()
+			conn.ctxerr = ctx.Err()
+			conn.mtx.Unlock()
+			conn.Close()
+		case <-conn.fin:
+		}
+	}()
+	return conn
+}
+
+// Context returns the context attached by WithContext, or
+// context.Background if there is none.  This lets handlers get at values
+// attached to the connection when it was accepted, such as by middleware.
+func (conn *ChanConn) Context() context.Context {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if conn.ctx == nil {
+		return context.Background()
+	}
+	return conn.ctx
+}
+
+// Detach gives up ownership of the connection, so that it can be handed
+// to another goroutine, which calls Attach before using it.  Coalesced
+// writes are still sent in the background.  Detach panics if a Read or
+// Write is in progress, or if the connection is already detached, as
+// either means that something else is still using it.  Detach and Attach
+// also order the memory accesses of the old owner before those of the new
+// one, which keeps the race detector quiet however the connection is
+// handed over.  Reads and Writes while detached are not checked.
+func (conn *ChanConn) Detach() {
+	// Holding cmtx keeps the flush timer from sending, which would look
+	// like a Write in progress.
+	conn.cmtx.Lock()
+	defer conn.cmtx.Unlock()
+	conn.setDetached(true, "Detach")
+}
+
+// Attach takes ownership of a connection given up by Detach.  It panics
+// if the connection is not detached, or if a Read or Write is in
+// progress.
+func (conn *ChanConn) Attach() {
+	conn.setDetached(false, "Attach")
+}
+
+// setDetached changes the detached state to detached, which must not be
+// the current state, checking that no I/O is in progress.  op names the
+// caller in the panic.
+func (conn *ChanConn) setDetached(detached bool, op string) {
+	if atomic.LoadInt32(&conn.rbusy) != 0 {
+		panic("chanstream: " + op + " with a Read in progress")
+	}
+	if atomic.LoadInt32(&conn.wbusy) != 0 {
+		panic("chanstream: " + op + " with a Write in progress")
+	}
+	conn.mtx.Lock()
+	ok := conn.detached != detached
+	conn.detached = detached
+	conn.mtx.Unlock()
+	if !ok {
+		if detached {
+			panic("chanstream: Detach of a detached connection")
+		}
+		panic("chanstream: Attach of a connection that is not detached")
+	}
+}
+
+// lockRead takes rmtx, counting the caller as a Read in progress.
+func (conn *ChanConn) lockRead() {
+	atomic.AddInt32(&conn.rbusy, 1)
+	conn.rmtx.Lock()
+}
+
+// unlockRead releases rmtx, taken by lockRead.
+func (conn *ChanConn) unlockRead() {
+	conn.rmtx.Unlock()
+	atomic.AddInt32(&conn.rbusy, -1)
+}
+
+// lockSend read-locks wmtx, which keeps CloseWrite from closing the fifo,
+// counting the caller as a Write in progress.
+func (conn *ChanConn) lockSend() {
+	atomic.AddInt32(&conn.wbusy, 1)
+	conn.wmtx.RLock()
+}
+
+// unlockSend releases wmtx, taken by lockSend.
+func (conn *ChanConn) unlockSend() {
+	conn.wmtx.RUnlock()
+	atomic.AddInt32(&conn.wbusy, -1)
+}
+
+// closedErr returns the error for using a connection that has been closed
+// locally, which is its context's error, if that is why.
+func (conn *ChanConn) closedErr() error {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if conn.ctxerr != nil {
+		return conn.ctxerr
+	}
+	return ErrConnClosed
+}
+
+// ConnStats is a snapshot of the activity on a connection.
+type ConnStats struct {
+	BytesRead    int64     // Bytes returned by Read and ReadMessage
+	BytesWritten int64     // Bytes sent to the peer
+	Messages     int64     // Messages sent and received
+	OpenedAt     time.Time // When the connection was established
+	ClosedAt     time.Time // When Close was called, or zero if not yet
+}
+
+// Stats returns a snapshot of the connection's activity, suitable for
+// logging when the connection is closed.
+func (conn *ChanConn) Stats() ConnStats {
+	conn.mtx.Lock()
+	closed := conn.closed
+	conn.mtx.Unlock()
+	return ConnStats{
+		BytesRead:    atomic.LoadInt64(&conn.nread),
+		BytesWritten: atomic.LoadInt64(&conn.nwritten),
+		Messages:     atomic.LoadInt64(&conn.nmsgs),
+		OpenedAt:     conn.opened,
+		ClosedAt:     closed,
+	}
+}
+
+// CloseRead closes the read side of the connection.  Addtionally, a
+// notification is sent to the peer, to begin an orderly shutdown of the
+// connection.  No further data may be read from the connection, but
+// writing is unaffected.  Closing an already closed side has no effect.
+func (conn *ChanConn) CloseRead() error {
+	conn.mtx.Lock()
+	stop := conn.rdstop
+	conn.rdstop = nil
+	if conn.rclosed {
+		conn.mtx.Unlock()
+		return nil
+	}
+	conn.rclosed = true
+	close(conn.fin)
+	conn.mtx.Unlock()
+	if stop != nil {
+		// Closed before CloseReadGraceful got round to it.
+		stop()
+	}
+
+	conn.markDone()
+	if conn.peer != nil {
+		conn.peer.markDone()
+	}
+	return nil
+}
+
+// CloseReadGraceful closes the read side of the connection after d, like
+// CloseRead, but without discarding data.  Until then, reading carries on
+// as usual.  After that, the peer can no longer write, but Read still
+// returns the data the peer had already sent, and then io.EOF, rather
+// than ErrConnClosed.  This allows an orderly shutdown.  If the read side
+// is closed first, as by Close, it is not graceful, and Read fails with
+// ErrConnClosed as usual.
+func (conn *ChanConn) CloseReadGraceful(d time.Duration) error {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if conn.rclosed {
+		return nil
+	}
+	if conn.rdstop != nil {
+		conn.rdstop()
+	}
+	conn.rdstop = afterFunc(d, func() {
+		conn.mtx.Lock()
+		if conn.rclosed {
+			conn.mtx.Unlock()
+			return
+		}
+		conn.rdrain = true
+		conn.rdstop = nil
+		conn.mtx.Unlock()
+		conn.CloseRead()
+	})
+	return nil
+}
+
+// draining reports whether buffered data may still be read, after the
+// read side was closed by CloseReadGraceful.
+func (conn *ChanConn) draining() bool {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	return conn.rdrain
+}
+
+// drainRecv returns the next message that was buffered when the read side
+// was closed gracefully, or nil, meaning EOF, once there are no more.
+func (conn *ChanConn) drainRecv() ([]byte, error) {
+	select {
+	case msg, ok := <-conn.peer.fifo:
+		conn.received(msg)
+		if !ok {
+			return nil, nil
+		}
+		return msg, nil
+	default:
+		return nil, nil
+	}
+}
+
+// CloseWrite closes the write side of the channel.  After this point, it
+// is illegal to write data on the connection, and the peer will see io.EOF
+// once it has read what was already sent.  Reading is unaffected, so this
+// can be used to send a request and then read the complete response.
+// Any coalesced writes are sent first, see SetNoDelay; if that fails, the
+// rest of them are dropped, and the error is returned once the write side
+// is closed.
+func (conn *ChanConn) CloseWrite() error {
+	err := conn.closeBatch()
+	conn.mtx.Lock()
+	if conn.wclosed {
+		conn.mtx.Unlock()
+		return nil
+	}
+	conn.wclosed = true
+	close(conn.wfin)
+	conn.mtx.Unlock()
+
+	// Wait for any blocked writers to notice, as closing the fifo
+	// underneath them would cause a panic.  Closing the fifo, rather
+	// than sending a marker, ensures the peer sees EOF only once it
+	// has drained every message queued ahead of it.
+	conn.wmtx.Lock()
+	close(conn.fifo)
+	conn.wmtx.Unlock()
+	conn.markDone()
+	return err
+}
+
+// Done returns a channel that is closed once the connection is finished
+// with, much like the Done method of context.Context.  That is when both
+// halves have been closed locally, as by Close, or the peer has closed the
+// connection, whichever end closes first.  A half-closed connection is
+// not done.  This allows selecting on connection liveness in an event
+// loop.
+func (conn *ChanConn) Done() <-chan struct{} {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if conn.done == nil {
+		conn.done = make(chan struct{})
+		if conn.finished() {
+			close(conn.done)
+		}
+	}
+	return conn.done
+}
+
+// finished reports whether Done should fire.  The caller must hold mtx.
+func (conn *ChanConn) finished() bool {
+	return (conn.rclosed && conn.wclosed) ||
+		conn.peer == nil || conn.peer.readClosed()
+}
+
+// markDone closes the Done channel, if one has been handed out, and runs
+// the onDone hook, once the connection is finished.
+func (conn *ChanConn) markDone() {
+	conn.mtx.Lock()
+	if !conn.finished() {
+		conn.mtx.Unlock()
+		return
+	}
+	if conn.done != nil {
+		select {
+		case <-conn.done:
+		default:
+			close(conn.done)
+		}
+	}
+	onDone := conn.onDone
+	conn.onDone = nil
+	closed := conn.tracked && conn.rclosed && conn.wclosed
+	conn.mtx.Unlock()
+	if closed {
+		untrack(conn)
+	}
+	if onDone != nil {
+		onDone()
+	}
+}
+
+// IsClosed reports whether the connection is no longer fully usable,
+// because either half has been closed locally, or the peer has closed
+// its read side.  It is safe to call concurrently with Read and Write.
+func (conn *ChanConn) IsClosed() bool {
+	conn.mtx.Lock()
+	closed := conn.rclosed || conn.wclosed
+	conn.mtx.Unlock()
+	if closed || conn.peer == nil {
+		return true
+	}
+	select {
+	case <-conn.peer.fin:
+		return true
+	default:
+		return false
+	}
+}
+
+// PeerWriteClosed reports whether the peer has closed its write side, and
+// all of the data it sent has been read, so that the next Read would
+// return io.EOF.  This lets a reader stop reading without waiting for EOF.
+func (conn *ChanConn) PeerWriteClosed() bool {
+	if conn.peer == nil {
+		// Not properly connected, so as good as closed.
+		return true
+	}
+	conn.peer.mtx.Lock()
+	closed := conn.peer.wclosed
+	conn.peer.mtx.Unlock()
+	return closed && len(conn.peer.fifo) == 0 && len(conn.pending) == 0
+}
+
+// LocalAddr returns the local address.  For the server, this is the name
+// that was listened on.  For the client, it is a unique identifier made
+// from that name and a sequence number, like "name:7".
+func (conn *ChanConn) LocalAddr() net.Addr {
+	return conn.addr
+}
+
+// RemoteAddr returns the peer's address, which is its LocalAddr, or nil
+// if the connection has no peer.
+func (conn *ChanConn) RemoteAddr() net.Addr {
+	if conn.peer == nil {
+		return nil
+	}
+	return conn.peer.addr
+}
+
+// SetDeadline sets the timeout for both read and write.  Like the other
+// deadline setters, it fails with ErrConnClosed once the connection has
+// been closed.
+func (conn *ChanConn) SetDeadline(t time.Time) error {
+	if err := conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
+
+// SetDeadlineFromContext sets both the read and write deadlines to the
+// deadline of ctx, or clears them if ctx has no deadline.  Note that this
+// does not watch ctx for cancellation.
+func (conn *ChanConn) SetDeadlineFromContext(ctx context.Context) error {
+	t, _ := ctx.Deadline()
+	return conn.SetDeadline(t)
+}
+
+// SetReadIdleTimeout limits how long a Read may wait for data to arrive,
+// when none is already waiting to be read, to d.  Unlike the read deadline,
+// this starts afresh with each Read, and does not apply while the rest of a
+// message that has begun arriving is being read, much like the
+// ReadHeaderTimeout of an HTTP server.  A Read that waits too long fails
+// with ErrIdleTimeout, and loses no data.  The read deadline, if earlier,
+// still applies.  Zero, the default, means no limit.
+func (conn *ChanConn) SetReadIdleTimeout(d time.Duration) {
+	conn.mtx.Lock()
+	conn.idletmo = d
+	conn.mtx.Unlock()
+}
+
+// SetReadKeepAlive makes Read check that the peer is still alive, when no
+// data has arrived for interval, by sending it a probe, out of band, so
+// the data is untouched.  The peer answers a probe whenever it is waiting
+// in Read or Write, without its caller knowing.  If no answer comes within
+// timeout, the peer is taken to be dead, say because the goroutine that
+// served it exited without closing it, and Read fails with ErrKeepAlive.
+// Otherwise, the wait for data goes on, and another probe is sent after
+// another interval.  Zero interval, the default, means no probes.
+func (conn *ChanConn) SetReadKeepAlive(interval, timeout time.Duration) {
+	conn.mtx.Lock()
+	conn.kaint = interval
+	conn.katmo = timeout
+	conn.mtx.Unlock()
+}
+
+// keepAlive returns the keepalive interval and timeout.
+func (conn *ChanConn) keepAlive() (time.Duration, time.Duration) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	return conn.kaint, conn.katmo
+}
+
+// sendProbe asks the peer to show that it is alive.
+func (conn *ChanConn) sendProbe() {
+	select {
+	case conn.peer.probe <- struct{}{}:
+	default:
+		// One is already waiting to be answered.
+	}
+}
+
+// answerProbe answers a probe from the peer.
+func (conn *ChanConn) answerProbe() {
+	select {
+	case conn.peer.ack <- struct{}{}:
+	default:
+	}
+}
+
+// idleDeadline returns when a wait for data starting now should time out,
+// which is zero if there is no idle timeout.
+func (conn *ChanConn) idleDeadline() time.Time {
+	conn.mtx.Lock()
+	d := conn.idletmo
+	conn.mtx.Unlock()
+	if d <= 0 {
+		return time.Time{}
+	}
+	return now().Add(d)
+}
+
+// SetReadDeadline sets the timeout for read (receive).  A Read that times
+// out returns ErrRdTimeout, and loses no data: anything not yet returned
+// remains available, so the Read may simply be retried with a new deadline.
+// The zero time clears the deadline, including for a Read that is already
+// waiting, which then waits indefinitely.
+func (conn *ChanConn) SetReadDeadline(t time.Time) error {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if conn.rclosed && conn.wclosed {
+		return ErrConnClosed
+	}
+	conn.rdeadline = t
+	if conn.rdlchg != nil {
+		close(conn.rdlchg)
+		conn.rdlchg = nil
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the timeout for write (send).  A Write that times
+// out returns ErrWrTimeout, and has not sent anything, so the same data
+// may be written again later without being duplicated.
+func (conn *ChanConn) SetWriteDeadline(t time.Time) error {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if conn.rclosed && conn.wclosed {
+		return ErrConnClosed
+	}
+	conn.wdeadline = t
+	if conn.wdlchg != nil {
+		close(conn.wdlchg)
+		conn.wdlchg = nil
+	}
+	return nil
+}
+
+// readDeadline returns the read deadline, along with a channel that is
+// closed when it changes, so that a blocked Read can pick up the change.
+func (conn *ChanConn) readDeadline() (time.Time, <-chan struct{}) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if conn.rdlchg == nil {
+		conn.rdlchg = make(chan struct{})
+	}
+	return conn.rdeadline, conn.rdlchg
+}
+
+// writeDeadline is the counterpart of readDeadline for writing.
+func (conn *ChanConn) writeDeadline() (time.Time, <-chan struct{}) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if conn.wdlchg == nil {
+		conn.wdlchg = make(chan struct{})
+	}
+	return conn.wdeadline, conn.wdlchg
+}
+
+// expired reports whether the deadline t has passed.  Operations check
+// this before trying to transfer data, as otherwise an expired deadline
+// would race with data that is ready, and might not be honored.
+func expired(t time.Time) bool {
+	return !t.IsZero() && !now().Before(t)
+}
+
+// received notes that msg was taken from the peer's fifo, so that a peer
+// blocked in Flush can check whether its fifo has drained.  It also hands
+// a copy of msg to each mirror.
+func (conn *ChanConn) received(msg []byte) {
+	select {
+	case conn.peer.drained <- struct{}{}:
+	default:
+	}
+	if msg == nil {
+		return
+	}
+	atomic.AddInt64(&conn.nmsgs, 1)
+
+	conn.mtx.Lock()
+	mirrors := conn.mirrors
+	conn.mtx.Unlock()
+	for _, m := range mirrors {
+		if _, err := m.Write(msg); err != nil {
+			conn.dropMirror(m)
+		}
+	}
+}
+
+// Mirror arranges for every message received on this connection to also
+// be written to extra, so that its peer sees the same stream, much like
+// io.TeeReader.  A slow mirror slows down Read, as mirroring happens as
+// part of it, and a mirror that fails to accept a message is dropped.
+// Closing the connection does not close its mirrors.
+func (conn *ChanConn) Mirror(extra *ChanConn) error {
+	if extra == conn || extra == conn.peer {
+		// We would read our own writes, forever.
+		return ErrSelfPeer
+	}
+	if extra.IsClosed() {
+		return ErrConnClosed
+	}
+	conn.mtx.Lock()
+	conn.mirrors = append(conn.mirrors, extra)
+	conn.mtx.Unlock()
+	return nil
+}
+
+// dropMirror removes m from the mirrors.
+func (conn *ChanConn) dropMirror(m *ChanConn) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	mirrors := make([]*ChanConn, 0, len(conn.mirrors))
+	for _, x := range conn.mirrors {
+		if x != m {
+			mirrors = append(mirrors, x)
+		}
+	}
+	conn.mirrors = mirrors
+}
+
+// readClosed reports whether the read side has been closed locally.
+func (conn *ChanConn) readClosed() bool {
+	select {
+	case <-conn.fin:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetReadBuffer sets the size of the read buffer.  When a Read is given a
+// large enough slice, messages that are already waiting are coalesced into
+// a single Read, up to this many bytes, rather than returning one message
+// per Read.  Data is never delayed to do this.  The default is zero, which
+// disables coalescing.
+func (conn *ChanConn) SetReadBuffer(bytes int) error {
+	conn.mtx.Lock()
+	conn.rdbuf = bytes
+	conn.mtx.Unlock()
+	return nil
+}
+
+// SetMessageMode controls whether Read preserves message boundaries.  When
+// enabled, each Read returns data from at most one message, as written by
+// a single Write on the peer, much like receiving a datagram.  If b is too
+// small for the message, the remainder is returned by subsequent Reads.
+// An empty message results in a Read returning 0, nil, whereas in stream
+// mode empty messages are skipped over.  The default is stream mode,
+// where messages may be coalesced.
+func (conn *ChanConn) SetMessageMode(on bool) {
+	conn.mtx.Lock()
+	conn.msgmode = on
+	conn.mtx.Unlock()
+}
+
+// SetMaxMessageSize limits the size of the messages sent to the peer to n
+// bytes, protecting it from enormous messages.  If split is false, a Write
+// larger than n fails with ErrMsgTooLong; if it is true, the data is sent
+// as several messages of at most n bytes, which the peer reassembles when
+// reading in stream mode.  WriteMsg never splits a message.  Zero, the
+// default, means no limit.
+func (conn *ChanConn) SetMaxMessageSize(n int, split bool) {
+	conn.mtx.Lock()
+	conn.maxmsg = n
+	conn.split = split
+	conn.mtx.Unlock()
+}
+
+// SetReadLimit limits the total number of bytes that Read returns over
+// the life of the connection to n.  Once that many have been read, further
+// Reads fail with ErrReadLimit, unless the peer has sent nothing more, in
+// which case they block or report EOF as usual.  This keeps a runaway
+// peer from making a slow consumer buffer without bound, much like
+// http.MaxBytesReader.  Zero or less, the default, means no limit.
+func (conn *ChanConn) SetReadLimit(n int64) {
+	conn.mtx.Lock()
+	conn.rdlimit = n
+	conn.mtx.Unlock()
+}
+
+// maxMessage returns the maximum message size, or zero if there is none.
+func (conn *ChanConn) maxMessage() int {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	return conn.maxmsg
+}
+
+// splitting reports whether writes larger than the maximum message size
+// are split.
+func (conn *ChanConn) splitting() bool {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	return conn.split
+}
+
+// checkSize returns ErrMsgTooLong if a write of n bytes is too large to be
+// sent, as it exceeds the maximum message size and cannot be split.
+func (conn *ChanConn) checkSize(n int) error {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if conn.maxmsg > 0 && n > conn.maxmsg && !conn.split {
+		return ErrMsgTooLong
+	}
+	return nil
+}
+
+// Read implements the io.Reader interface.  As with a socket, Read waits
+// only until some data is available, and then returns what it has, even
+// if that does not fill b; it never waits for more.  So a Read that
+// returns data never also reports an error such as a timeout; that is
+// left for the next Read.  Once the peer has closed its write side, and
+// all data it sent has been read, io.EOF is returned.  If the read side is
+// closed locally instead, including while a Read is blocked, ErrConnClosed
+// is returned.  Reading into an empty b returns 0, nil immediately,
+// without waiting or consuming anything.
+func (conn *ChanConn) Read(b []byte) (int, error) {
+	return conn.read(b, time.Time{})
+}
+
+// ReadDeadline is like Read, but also gives up at t, if that is earlier
+// than the read deadline, failing with ErrRdTimeout.  Unlike calling
+// SetReadDeadline first, this affects only this call, so it is safe when
+// several goroutines share the connection, each with its own timeout.
+// The zero time means no extra deadline.
+func (conn *ChanConn) ReadDeadline(b []byte, t time.Time) (int, error) {
+	return conn.read(b, t)
+}
+
+// read does the work of Read, subject to the extra deadline dl.
+func (conn *ChanConn) read(b []byte, dl time.Time) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	conn.lockRead()
+	defer conn.unlockRead()
+	if conn.readClosed() && !conn.draining() {
+		return 0, conn.closedErr()
+	}
+	conn.mtx.Lock()
+	msgmode := conn.msgmode
+	rdbuf := conn.rdbuf
+	rdlimit := conn.rdlimit
+	conn.mtx.Unlock()
+
+	if rdlimit > 0 {
+		left := rdlimit - atomic.LoadInt64(&conn.nread)
+		if left <= 0 {
+			return 0, conn.overLimit(dl)
+		}
+		if int64(len(b)) > left {
+			b = b[:left]
+		}
+	}
+
+	n := 0
+	for n < len(b) {
+
+		// get a byte slice from our peer if we don't have one yet
+		if len(conn.pending) == 0 {
+			if n > 0 {
+				// Coalesce messages that are already waiting, up
+				// to the read buffer size, but never block for them.
+				if msgmode || n >= rdbuf {
+					return n, nil
+				}
+				if t, _ := conn.readDeadline(); expired(earliest(t, dl)) {
+					// Only what was already here.
+					return n, nil
+				}
+				select {
+				case msg, ok := <-conn.peer.fifo:
+					conn.received(msg)
+					if !ok {
+						// EOF, which the next Read reports
+						conn.eof = true
+						return n, nil
+					}
+					conn.pending = msg
+					conn.pendbuf = msg
+					continue
+				default:
+					return n, nil
+				}
+			}
+			msg, err := conn.recv(dl)
+			if err != nil {
+				return 0, err
+			}
+			if msg == nil {
+				return 0, io.EOF
+			}
+			if len(msg) == 0 && msgmode {
+				// An empty message is delivered as such,
+				// but in stream mode it is just skipped.
+				return 0, nil
+			}
+			conn.pending = msg
+			conn.pendbuf = msg
+		}
+
+		want := copy(b[n:], conn.pending)
+		n += want
+		atomic.AddInt64(&conn.nread, int64(want))
+		conn.pending = conn.pending[want:]
+		if len(conn.pending) == 0 {
+			conn.recycle(conn.pendbuf)
+			conn.pendbuf = nil
+		}
+	}
+	return n, nil
+}
+
+// overLimit is called by Read once the read limit has been reached.  It
+// waits for more data, as Read would, so that EOF and errors are still
+// reported as such, and returns ErrReadLimit if any arrives.
+func (conn *ChanConn) overLimit(dl time.Time) error {
+	for len(conn.pending) == 0 {
+		msg, err := conn.recv(dl)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			return io.EOF
+		}
+		// Empty messages carry no data, so do not count.
+		conn.pending = msg
+		conn.pendbuf = msg
+	}
+	return ErrReadLimit
+}
+
+// ReadMessage returns the next message from the peer, or the rest of it
+// if a Read has already consumed part of it.  Unlike Read, no copy is
+// made: the caller takes ownership of the buffer, which is the one the
+// peer's Write filled in.  The caller must not assume the buffer is
+// pooled/reused unless SetBufferPool was used.  This is the read side
+// counterpart of WriteMsg.  The read limit applies as it does to Read: a
+// message that crosses it is cut short, and the rest is kept for later.
+func (conn *ChanConn) ReadMessage() ([]byte, error) {
+	conn.lockRead()
+	defer conn.unlockRead()
+	if conn.readClosed() && !conn.draining() {
+		return nil, conn.closedErr()
+	}
+	conn.mtx.Lock()
+	rdlimit := conn.rdlimit
+	conn.mtx.Unlock()
+	if rdlimit > 0 && atomic.LoadInt64(&conn.nread) >= rdlimit {
+		return nil, conn.overLimit(time.Time{})
+	}
+
+	msg := conn.pending
+	conn.pending = nil
+	conn.pendbuf = nil
+	if len(msg) == 0 {
+		var err error
+		if msg, err = conn.recv(time.Time{}); err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			return nil, io.EOF
+		}
+	}
+	if rdlimit > 0 {
+		if left := rdlimit - atomic.LoadInt64(&conn.nread); int64(len(msg)) > left {
+			// The caller owns the buffer, so the rest must not be
+			// recycled once it is read.
+			conn.pending = msg[left:]
+			msg = msg[:left:left]
+		}
+	}
+	atomic.AddInt64(&conn.nread, int64(len(msg)))
+	return msg, nil
+}
+
+// Handshake sends send to the peer as a single message, and then waits
+// for the peer's reply, which it returns, as for a simple request and
+// response exchange before the main protocol starts.  The whole exchange
+// must complete within timeout, or it fails with a timeout error, as a
+// net.Error.  Zero means no limit.  Any existing deadlines still apply,
+// and are restored afterwards.
+func (conn *ChanConn) Handshake(send []byte, timeout time.Duration) ([]byte, error) {
+	conn.mtx.Lock()
+	rd, wd := conn.rdeadline, conn.wdeadline
+	conn.mtx.Unlock()
+	if timeout > 0 {
+		t := now().Add(timeout)
+		if err := conn.SetReadDeadline(earliest(rd, t)); err != nil {
+			return nil, err
+		}
+		conn.SetWriteDeadline(earliest(wd, t))
+		defer func() {
+			conn.SetReadDeadline(rd)
+			conn.SetWriteDeadline(wd)
+		}()
+	}
+	if err := conn.WriteMsg(send); err != nil {
+		return nil, err
+	}
+	return conn.ReadMessage()
+}
+
+// earliest returns the earlier of two deadlines, where zero means none.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// recv waits for the next message from the peer, subject to the read
+// deadline, the extra deadline dl, and the idle timeout.  A nil message
+// means that the peer has closed its write side.
+func (conn *ChanConn) recv(dl time.Time) ([]byte, error) {
+	if conn.peer == nil {
+		return nil, ErrConnClosed
+	}
+	if conn.peer == conn {
+		return nil, ErrSelfPeer
+	}
+	if conn.readClosed() && conn.draining() {
+		return conn.drainRecv()
+	}
+	if conn.eof {
+		// Once seen, EOF is reported for good, even if the
+		// deadline has since passed.
+		return nil, nil
+	}
+	idle := conn.idleDeadline()
+	var timer <-chan time.Time
+	stop := nopStop
+	defer func() { stop() }()
+
+	// The keepalive timer runs for the interval, and then, once a
+	// probe has been sent, for the timeout.
+	interval, katmo := conn.keepAlive()
+	var ka <-chan time.Time
+	kstop := nopStop
+	defer func() { kstop() }()
+	if interval > 0 {
+		ka, kstop = mkTimer(now().Add(interval))
+	}
+	probing := false
+	for {
+		t, changed := conn.readDeadline()
+		t = earliest(t, dl)
+		if expired(t) {
+			return nil, ErrRdTimeout
+		}
+		if expired(idle) {
+			return nil, ErrIdleTimeout
+		}
+		stop()
+		timer, stop = mkTimer(earliest(t, idle))
+
+		select {
+		case msg, ok := <-conn.peer.fifo:
+			conn.received(msg)
+			if !ok {
+				// The peer closed the fifo, and everything it
+				// sent before then has been read.
+				conn.eof = true
+				return nil, nil
+			}
+			return msg, nil
+
+		case <-conn.fin:
+			// Local close underneath us
+			if conn.draining() {
+				return conn.drainRecv()
+			}
+			return nil, conn.closedErr()
+
+		case <-timer:
+			// Timeout
+			if expired(t) {
+				return nil, ErrRdTimeout
+			}
+			return nil, ErrIdleTimeout
+
+		case <-changed:
+			// New deadline, go around again
+
+		case <-ka:
+			if probing {
+				return nil, ErrKeepAlive
+			}
+			conn.sendProbe()
+			probing = true
+			kstop()
+			ka, kstop = mkTimer(now().Add(katmo))
+
+		case <-conn.ack:
+			if interval > 0 {
+				probing = false
+				kstop()
+				ka, kstop = mkTimer(now().Add(interval))
+			}
+
+		case <-conn.probe:
+			conn.answerProbe()
+		}
+	}
+}
+
+// Peek returns the next n bytes without consuming them, so that they are
+// returned again by the next Read, like bufio.Reader.Peek.  This allows
+// a protocol to be sniffed before handing off the connection.  If fewer
+// than n bytes can be had, because of EOF or the read deadline, those that
+// are available are returned, along with the error.  The returned slice is
+// only valid until the next Read.  A negative n fails with
+// bufio.ErrNegativeCount.  In message mode, Peek looks no further than the
+// next message, so that Read still returns it alone; if it is shorter
+// than n, all of it is returned, without an error.
+func (conn *ChanConn) Peek(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, bufio.ErrNegativeCount
+	}
+	conn.lockRead()
+	defer conn.unlockRead()
+	if conn.readClosed() && !conn.draining() {
+		return nil, conn.closedErr()
+	}
+	conn.mtx.Lock()
+	msgmode := conn.msgmode
+	conn.mtx.Unlock()
+	for len(conn.pending) < n {
+		if msgmode && len(conn.pending) > 0 {
+			return conn.pending, nil
+		}
+		msg, err := conn.recv(time.Time{})
+		if err == nil && msg == nil {
+			err = io.EOF
+		}
+		if err != nil {
+			return conn.pending, err
+		}
+		if len(conn.pending) == 0 {
+			conn.pending = msg
+			conn.pendbuf = msg
+			if msgmode {
+				break
+			}
+			continue
+		}
+		pending := make([]byte, 0, len(conn.pending)+len(msg))
+		pending = append(pending, conn.pending...)
+		pending = append(pending, msg...)
+		conn.recycle(conn.pendbuf)
+		conn.recycle(msg)
+		conn.pending = pending
+		conn.pendbuf = pending
+	}
+	if len(conn.pending) < n {
+		return conn.pending, nil
+	}
+	return conn.pending[:n], nil
+}
+
+// ReadFull reads exactly len(b) bytes, reassembling them from as many
+// messages as needed.  If the stream ends early, io.ErrUnexpectedEOF is
+// returned, and if the read deadline expires, ErrRdTimeout is; in either
+// case n reports the bytes read so far.
+func (conn *ChanConn) ReadFull(b []byte) (int, error) {
+	return io.ReadFull(conn, b)
+}
+
+// maxFrame is the largest frame that WriteFrame sends and ReadFrame accepts.
+const maxFrame = 16 << 20
+
+// WriteFrame writes b as a frame: its length, as 4 bytes in big-endian
+// order, followed by b itself.  Unlike message boundaries, which Read in
+// stream mode does not preserve, frames survive any reassembly, and are
+// understood by peers that are not chanstream connections.  The frame is
+// sent with a single Write.  Frames larger than 16MiB fail with
+// ErrMsgTooLong.
+func (conn *ChanConn) WriteFrame(b []byte) error {
+	if len(b) > maxFrame {
+		return ErrMsgTooLong
+	}
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+	_, err := conn.Write(frame)
+	return err
+}
+
+// ReadFrame reads a frame written by WriteFrame, and returns its payload.
+// A length larger than WriteFrame allows fails with ErrMsgTooLong, as the
+// stream cannot be trusted after that.  If the stream ends within a
+// frame, io.ErrUnexpectedEOF is returned; if it ends between frames,
+// io.EOF is.
+func (conn *ChanConn) ReadFrame() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxFrame {
+		return nil, ErrMsgTooLong
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// Write implements the io.Writer interface.  Each Write is sent as a
+// single message, unless coalescing has been enabled with SetNoDelay.  If
+// the buffer to the peer is full, Write waits for the peer to make room,
+// until the write deadline expires or the peer closes.  A timed out Write
+// reports ErrConnClosed rather than ErrWrTimeout if the peer has closed
+// by then, so a stalled peer can be told from a dead one.
+func (conn *ChanConn) Write(b []byte) (int, error) {
+	// Unlike Read, Write is quite a bit simpler, since
+	// we don't have to deal with buffers.  We just write to the
+	// channel/fifo.  We do have to respect when the peer has notified
+	// us that its side is closed, however.
+
+	// We have to make a copy to ensure that once a message is sent to
+	// us, we are insulated against later modification by the sender.
+	// Later we should consider limiting the size of this array to
+	// prevent someone from trying to send ridiculous message sizes all
+	// at once.  (E.g. avoid trying to alloc and copy 100 megabytes here!)
+	if n, ok, err := conn.coalesce(b); ok {
+		return n, err
+	}
+	if err := conn.checkSize(len(b)); err != nil {
+		return 0, err
+	}
+	a := conn.alloc(len(b))
+	copy(a, b)
+	return conn.sendLimited(a, conn.splitting(), time.Time{})
+}
+
+// WriteDeadline is like Write, but also gives up at t, if that is earlier
+// than the write deadline, failing with ErrWrTimeout.  Like ReadDeadline,
+// this affects only this call.  The data is never coalesced with other
+// writes, see SetNoDelay, but any that are pending are sent first.  The
+// zero time means no extra deadline.
+func (conn *ChanConn) WriteDeadline(b []byte, t time.Time) (int, error) {
+	if err := conn.flushBatch(); err != nil {
+		return 0, err
+	}
+	if err := conn.checkSize(len(b)); err != nil {
+		return 0, err
+	}
+	a := conn.alloc(len(b))
+	copy(a, b)
+	return conn.sendLimited(a, conn.splitting(), t)
+}
+
+// Limits on coalesced writes, see SetNoDelay.
+const (
+	coalesceSize  = 4096
+	closeLinger   = time.Second
+	coalesceDelay = time.Millisecond
+)
+
+// SetNoDelay controls whether each Write is sent at once, which is the
+// default, or small writes are coalesced, like Nagle's algorithm in TCP.
+// When coalescing, Write adds data to a batch, which is sent as a single
+// message once it holds 4 KB, a millisecond after the first write to it,
+// or on Flush or Close, whichever comes first.  This saves channel
+// operations for bursts of tiny writes, at the cost of latency.  As a
+// batch may be sent after its Writes returned, an error sending it is
+// reported by the next Write or Flush.  Closing sends the batch, waiting
+// for the peer to make room until the write deadline, or for at most a
+// second if there is none; what cannot be sent by then is dropped, and
+// Close reports the error.
+func (conn *ChanConn) SetNoDelay(noDelay bool) error {
+	conn.cmtx.Lock()
+	conn.delay = !noDelay
+	conn.cmtx.Unlock()
+	if noDelay {
+		return conn.flushBatch()
+	}
+	return nil
+}
+
+// coalesce adds b to the batch of coalesced writes, if coalescing is
+// enabled, which ok reports.
+func (conn *ChanConn) coalesce(b []byte) (n int, ok bool, err error) {
+	conn.cmtx.Lock()
+	defer conn.cmtx.Unlock()
+	if !conn.delay {
+		return 0, false, nil
+	}
+	if err := conn.werr; err != nil {
+		conn.werr = nil
+		return 0, true, err
+	}
+	conn.mtx.Lock()
+	closed := conn.wclosed
+	conn.mtx.Unlock()
+	if closed {
+		return 0, true, conn.closedErr()
+	}
+	if t, _ := conn.writeDeadline(); expired(t) {
+		// Buffering would succeed, but a past deadline must fail
+		// every Write, as it does when the data is sent at once.
+		return 0, true, conn.writeTimeout()
+	}
+	if err := conn.checkSize(len(b)); err != nil {
+		return 0, true, err
+	}
+
+	if conn.wbuf == nil {
+		conn.wbuf = conn.alloc(coalesceSize)[:0]
+	}
+	prev := len(conn.wbuf)
+	conn.wbuf = append(conn.wbuf, b...)
+	if len(conn.wbuf) >= coalesceSize {
+		if err := conn.sendBatch(); err != nil {
+			// Take b back out, so that a retry does not repeat it.
+			conn.wbuf = conn.wbuf[:prev]
+			return 0, true, err
+		}
+	} else if conn.wtimer == nil {
+		conn.wtimer = time.AfterFunc(coalesceDelay, conn.flushTimer)
+	}
+	return len(b), true, nil
+}
+
+// sendBatch sends the batch of coalesced writes.  If that fails, the batch
+// is kept, so it can be retried.  The caller must hold cmtx.
+func (conn *ChanConn) sendBatch() error {
+	if conn.wtimer != nil {
+		conn.wtimer.Stop()
+		conn.wtimer = nil
+	}
+	if len(conn.wbuf) == 0 {
+		return nil
+	}
+	batch := conn.wbuf
+	conn.wbuf = nil
+	// Batches have no boundaries to preserve, so may always be split.
+	if n, err := conn.sendLimited(batch, true, time.Time{}); err != nil {
+		conn.wbuf = batch[n:]
+		return err
+	}
+	return nil
+}
+
+// flushBatch sends any coalesced writes.
+func (conn *ChanConn) flushBatch() error {
+	conn.cmtx.Lock()
+	defer conn.cmtx.Unlock()
+	conn.werr = nil
+	return conn.sendBatch()
+}
+
+// flushTimer sends the batch of coalesced writes once it has waited long
+// enough, saving any error for the next Write.  It never waits for the
+// peer to make room, as that would hold cmtx indefinitely, so blocking
+// Close and Detach.  Instead, it tries again after another coalesceDelay,
+// until the write deadline expires.
+func (conn *ChanConn) flushTimer() {
+	conn.cmtx.Lock()
+	defer conn.cmtx.Unlock()
+	conn.wtimer = nil
+	if len(conn.wbuf) == 0 {
+		return
+	}
+	batch := conn.wbuf
+	conn.wbuf = nil
+	n, err := conn.sendChunks(batch, true, conn.sendNow)
+	if n < len(batch) {
+		conn.wbuf = batch[n:]
+	}
+	if err == ErrWouldBlock {
+		if t, _ := conn.writeDeadline(); !expired(t) {
+			conn.wtimer = time.AfterFunc(coalesceDelay, conn.flushTimer)
+			return
+		}
+		err = conn.writeTimeout()
+	}
+	if err != nil {
+		conn.werr = err
+	}
+}
+
+// closeBatch sends the batch of coalesced writes when closing, waiting
+// for the peer to make room until the write deadline, or for closeLinger
+// if there is none.  Whatever cannot be sent by then is dropped, and the
+// error is returned.
+func (conn *ChanConn) closeBatch() error {
+	conn.cmtx.Lock()
+	defer conn.cmtx.Unlock()
+	if conn.wtimer != nil {
+		conn.wtimer.Stop()
+		conn.wtimer = nil
+	}
+	batch := conn.wbuf
+	conn.wbuf = nil
+	if len(batch) == 0 {
+		return nil
+	}
+	var dl time.Time
+	if t, _ := conn.writeDeadline(); t.IsZero() {
+		dl = now().Add(closeLinger)
+	}
+	_, err := conn.sendLimited(batch, true, dl)
+	return err
+}
+
+// WriteWithPressure is like Write, but also reports how full the buffer
+// to the peer is once the message has been sent, from 0 (empty) to 1
+// (full).  A sender can use this to slow down as the peer falls behind,
+// before its writes start to block.  Connections without a buffer, such as
+// those from PipeChanSync, always report 0.
+func (conn *ChanConn) WriteWithPressure(b []byte) (int, float64, error) {
+	n, err := conn.Write(b)
+	return n, conn.pressure(), err
+}
+
+// pressure returns the fraction of the buffer to the peer in use.
+func (conn *ChanConn) pressure() float64 {
+	if cap(conn.fifo) == 0 {
+		return 0
+	}
+	return float64(len(conn.fifo)) / float64(cap(conn.fifo))
+}
+
+// WriteString is like Write, but takes a string, which it copies directly
+// into the message.  This implements io.StringWriter, and avoids the extra
+// allocation of converting the string to a []byte first.
+func (conn *ChanConn) WriteString(s string) (int, error) {
+	conn.cmtx.Lock()
+	delay := conn.delay
+	conn.cmtx.Unlock()
+	if delay {
+		return conn.Write([]byte(s))
+	}
+	if err := conn.checkSize(len(s)); err != nil {
+		return 0, err
+	}
+	a := conn.alloc(len(s))
+	copy(a, s)
+	return conn.sendLimited(a, conn.splitting(), time.Time{})
+}
+
+// WriteMsg sends b to the peer as exactly one message.  The message is
+// delivered whole: a concurrent WriteMsg from another goroutine can come
+// before or after it, but never in the middle of it.
+func (conn *ChanConn) WriteMsg(b []byte) error {
+	if err := conn.flushBatch(); err != nil {
+		return err
+	}
+	if max := conn.maxMessage(); max > 0 && len(b) > max {
+		// A message is never split.
+		return ErrMsgTooLong
+	}
+	a := conn.alloc(len(b))
+	copy(a, b)
+	_, err := conn.send(a, time.Time{})
+	return err
+}
+
+// Sender returns an io.Writer for one of several goroutines sharing this
+// connection.  Each Write on it is sent with WriteMsg, so frames written
+// by concurrent senders are never interleaved with each other.  Beyond
+// that, the order in which frames from different senders arrive is
+// undefined.
+func (conn *ChanConn) Sender() io.Writer {
+	return &chanSender{conn: conn}
+}
+
+// chanSender is the io.Writer returned by Sender.
+type chanSender struct {
+	conn *ChanConn
+}
+
+func (s *chanSender) Write(b []byte) (int, error) {
+	if err := s.conn.WriteMsg(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteBuffers writes the contents of bufs as a single message, which is
+// much cheaper than writing many small buffers one at a time.  This is the
+// equivalent of writev.  As with Buffers.WriteTo, the consumed buffers are
+// removed from bufs.  (The net package only uses writev for its own types,
+// so callers must use this directly rather than via bufs.WriteTo.)
+func (conn *ChanConn) WriteBuffers(bufs *net.Buffers) (int64, error) {
+	if err := conn.flushBatch(); err != nil {
+		return 0, err
+	}
+	size := 0
+	for _, b := range *bufs {
+		size += len(b)
+	}
+	if err := conn.checkSize(size); err != nil {
+		return 0, err
+	}
+	a := conn.alloc(size)[:0]
+	for _, b := range *bufs {
+		a = append(a, b...)
+	}
+	n, err := conn.sendLimited(a, conn.splitting(), time.Time{})
+	if err == nil {
+		*bufs = (*bufs)[len(*bufs):]
+	}
+	return int64(n), err
+}
+
+// SetBufferPool arranges for the buffers used to hold written messages to
+// come from pool, which must hold values of type []byte.  The peer returns
+// each buffer to the pool once it has read all of the data in it, so
+// that buffers are reused rather than garbage collected.  This can
+// substantially reduce allocation when sending many messages.  A buffer
+// is only returned once the peer is done with it: buffers handed over by
+// ReadMessage are never returned.  Building with the chanstreamdebug tag
+// adds checks that panic if a buffer is returned twice, or written to
+// after it was returned.
+func (conn *ChanConn) SetBufferPool(pool *sync.Pool) {
+	conn.mtx.Lock()
+	conn.pool = pool
+	conn.mtx.Unlock()
+}
+
+// alloc returns a buffer of n bytes for a message, from the buffer pool
+// if there is one.
+func (conn *ChanConn) alloc(n int) []byte {
+	conn.mtx.Lock()
+	pool := conn.pool
+	conn.mtx.Unlock()
+	if pool != nil {
+		b, ok := pool.Get().([]byte)
+		if ok && poolDebug {
+			// Even a buffer too small to use must be forgotten.
+			checkReuse(b, false)
+		}
+		if ok && cap(b) >= n {
+			return b[:n]
+		}
+	}
+	b := make([]byte, n)
+	if poolDebug && pool != nil {
+		checkReuse(b, true)
+	}
+	return b
+}
+
+// recycle returns a message buffer that has been completely read to the
+// pool of the peer that sent it, if it has one.
+func (conn *ChanConn) recycle(buf []byte) {
+	conn.peer.mtx.Lock()
+	pool := conn.peer.pool
+	conn.peer.mtx.Unlock()
+	if pool != nil && cap(buf) > 0 {
+		if poolDebug {
+			checkRecycle(buf)
+		}
+		pool.Put(buf[:0])
+	}
+}
+
+// recycled holds the buffers that are in a pool, when poolDebug is set.
+var recycled struct {
+	mtx sync.Mutex
+	m   map[*byte]bool
+}
+
+// poison fills recycled buffers, when poolDebug is set, so that reading
+// one that is still in use gives obvious garbage.
+const poison = 0xa5
+
+// checkRecycle panics if buf is already in a pool, and otherwise poisons
+// it, and notes that it is.
+func checkRecycle(buf []byte) {
+	buf = buf[:cap(buf)]
+	recycled.mtx.Lock()
+	defer recycled.mtx.Unlock()
+	if recycled.m == nil {
+		recycled.m = make(map[*byte]bool)
+	}
+	if recycled.m[&buf[0]] {
+		panic("chanstream: buffer recycled twice")
+	}
+	recycled.m[&buf[0]] = true
+	for i := range buf {
+		buf[i] = poison
+	}
+}
+
+// checkReuse notes that buf has been taken from a pool, and panics if it
+// was written to while it was there.  Buffers that were not recycled by
+// us, such as those made by the pool's New, are not checked.  A fresh
+// buffer may have the address of one that the pool dropped, so that is
+// forgotten.
+func checkReuse(buf []byte, fresh bool) {
+	buf = buf[:cap(buf)]
+	if len(buf) == 0 {
+		return
+	}
+	recycled.mtx.Lock()
+	defer recycled.mtx.Unlock()
+	was := recycled.m[&buf[0]]
+	delete(recycled.m, &buf[0])
+	if fresh || !was {
+		return
+	}
+	for _, c := range buf {
+		if c != poison {
+			panic("chanstream: buffer used after it was recycled")
+		}
+	}
+}
+
+// sendLimited sends b as a single message, or if split is set, as many
+// messages as the maximum message size requires, subject to the extra
+// deadline dl.  It returns the number of bytes sent.
+func (conn *ChanConn) sendLimited(b []byte, split bool,
+	dl time.Time) (int, error) {
+
+	return conn.sendChunks(b, split, func(chunk []byte) (int, error) {
+		return conn.send(chunk, dl)
+	})
+}
+
+// sendChunks does the work of sendLimited, using send to transmit each
+// message.
+func (conn *ChanConn) sendChunks(b []byte, split bool,
+	send func([]byte) (int, error)) (int, error) {
+
+	max := conn.maxMessage()
+	if max <= 0 || len(b) <= max {
+		return send(b)
+	}
+	if !split {
+		return 0, ErrMsgTooLong
+	}
+	n := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > max {
+			// Cap the chunk, so that recycling it cannot reach the next.
+			chunk = chunk[:max:max]
+		}
+		m, err := send(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// send transmits b as a single message, subject to the write deadline and
+// the extra deadline dl.  The caller must not modify b afterwards, as
+// ownership passes to the peer.  The message is sent whole or not at all,
+// so the count returned is len(b) on success, and zero on error.
+func (conn *ChanConn) send(b []byte, dl time.Time) (int, error) {
+	if conn.peer == nil {
+		// Not properly connected, so as good as closed.
+		return 0, ErrConnClosed
+	}
+	if conn.peer == conn {
+		return 0, ErrSelfPeer
+	}
+	if b == nil {
+		// Only a closed fifo may yield nil, which means EOF.
+		b = []byte{}
+	}
+	// Holding wmtx keeps CloseWrite from closing the fifo until we
+	// are done with it.
+	conn.lockSend()
+	defer conn.unlockSend()
+	conn.mtx.Lock()
+	closed := conn.wclosed
+	conn.mtx.Unlock()
+	if closed {
+		return 0, conn.closedErr()
+	}
+
+	var deadline <-chan time.Time
+	stop := nopStop
+	defer func() { stop() }()
+	warn, wstop := deadlockTimer()
+	defer wstop()
+
+	for {
+		t, changed := conn.writeDeadline()
+		t = earliest(t, dl)
+		if expired(t) {
+			return 0, conn.writeTimeout()
+		}
+		if conn.peer.readClosed() {
+			// Don't leave it to chance in the select below.
+			return 0, ErrConnClosed
+		}
+		stop()
+		deadline, stop = mkTimer(t)
+
+		select {
+		case <-conn.peer.fin:
+			// Remote close
+			return 0, ErrConnClosed
+
+		case <-conn.wfin:
+			// Local close underneath us
+			return 0, conn.closedErr()
+
+		case conn.fifo <- b:
+			// Sent it
+			atomic.AddInt64(&conn.nwritten, int64(len(b)))
+			atomic.AddInt64(&conn.nmsgs, 1)
+			return len(b), nil
+
+		case <-deadline:
+			// Timeout
+			return 0, conn.writeTimeout()
+
+		case <-changed:
+			// New deadline, go around again
+
+		case <-conn.probe:
+			conn.answerProbe()
+
+		case <-warn:
+			log.Printf("chanstream: write to %s blocked for %v, "+
+				"is anyone reading?", conn.peer.addr, deadlockWarnAfter())
+			warn = nil
+		}
+	}
+}
+
+// sendNow is like send, but fails with ErrWouldBlock rather than wait for
+// the peer to make room.
+func (conn *ChanConn) sendNow(b []byte) (int, error) {
+	if conn.peer == nil {
+		return 0, ErrConnClosed
+	}
+	if conn.peer == conn {
+		return 0, ErrSelfPeer
+	}
+	conn.lockSend()
+	defer conn.unlockSend()
+	conn.mtx.Lock()
+	closed := conn.wclosed
+	conn.mtx.Unlock()
+	if closed {
+		return 0, conn.closedErr()
+	}
+	if conn.peer.readClosed() {
+		return 0, ErrConnClosed
+	}
+	select {
+	case conn.fifo <- b:
+		atomic.AddInt64(&conn.nwritten, int64(len(b)))
+		atomic.AddInt64(&conn.nmsgs, 1)
+		return len(b), nil
+	default:
+		return 0, ErrWouldBlock
+	}
+}
+
+// writeTimeout returns the error for a write whose deadline expired.  If
+// the peer has gone away, ErrConnClosed is more useful than ErrWrTimeout,
+// which means the peer is alive but not reading.
+func (conn *ChanConn) writeTimeout() error {
+	if conn.peer == nil {
+		return ErrConnClosed
+	}
+	select {
+	case <-conn.peer.fin:
+		return ErrConnClosed
+	default:
+		return ErrWrTimeout
+	}
+}
+
+// deadlockWarnings controls logging of writes that block for a long time.
+var deadlockWarnings struct {
+	mtx   sync.Mutex
+	on    bool
+	after time.Duration
+}
+
+// EnableDeadlockWarnings turns on (or off) logging of a warning whenever a
+// Write has been blocked for several seconds, because nobody is reading
+// from the peer.  Such a hang is most often a goroutine that both writes
+// and reads a connection, or dials and accepts, and is otherwise silent.
+// This is a debugging aid, and is off by default.
+func EnableDeadlockWarnings(on bool) {
+	deadlockWarnings.mtx.Lock()
+	deadlockWarnings.on = on
+	deadlockWarnings.mtx.Unlock()
+}
+
+// deadlockWarnAfter returns how long a Write may block before a warning.
+func deadlockWarnAfter() time.Duration {
+	deadlockWarnings.mtx.Lock()
+	defer deadlockWarnings.mtx.Unlock()
+	if deadlockWarnings.after == 0 {
+		return 5 * time.Second
+	}
+	return deadlockWarnings.after
+}
+
+// deadlockTimer returns a timer for warning about a stuck Write, which is
+// nil if warnings are disabled.
+func deadlockTimer() (<-chan time.Time, func()) {
+	deadlockWarnings.mtx.Lock()
+	on := deadlockWarnings.on
+	deadlockWarnings.mtx.Unlock()
+	if !on {
+		return nil, nopStop
+	}
+	return mkTimer(now().Add(deadlockWarnAfter()))
+}
+
+// Flush blocks until the peer has received every message that has been
+// written on this connection.  Because Write merely enqueues data, a
+// successful Write does not mean the peer has seen it; Flush provides that
+// confirmation.  The write deadline is honored while waiting; as for
+// Write, a timed out Flush reports ErrConnClosed if the peer has closed.
+func (conn *ChanConn) Flush() error {
+	if err := conn.flushBatch(); err != nil {
+		return err
+	}
+	if conn.peer == nil {
+		return ErrConnClosed
+	}
+	var deadline <-chan time.Time
+	stop := nopStop
+	defer func() { stop() }()
+	for len(conn.fifo) > 0 {
+		if conn.UndeliveredCount() > 0 {
+			return ErrConnClosed
+		}
+		t, changed := conn.writeDeadline()
+		if expired(t) {
+			return conn.writeTimeout()
+		}
+		stop()
+		deadline, stop = mkTimer(t)
+
+		select {
+		case <-conn.drained:
+			// Something was received, check again.
+
+		case <-conn.peer.fin:
+			// Remote close, it will never drain
+			return ErrConnClosed
+
+		case <-deadline:
+			return conn.writeTimeout()
+
+		case <-changed:
+			// New deadline, check again.
+		}
+	}
+	return nil
+}
+
+// Buffered returns the number of messages written on this connection that
+// have not yet been received by the peer.
+func (conn *ChanConn) Buffered() int {
+	return len(conn.fifo)
+}
+
+// UndeliveredCount returns the number of messages written on this
+// connection that the peer will never read, because it closed its read
+// side before taking them.  Writes that succeeded are only known to have
+// been enqueued, so this tells how many of them were lost.  Once the peer
+// has closed, Write and Flush also fail with ErrConnClosed.
+func (conn *ChanConn) UndeliveredCount() int {
+	if conn.peer == nil || !conn.peer.readClosed() || conn.peer.draining() {
+		return 0
+	}
+	return len(conn.fifo)
+}
+
+// ReaderFrom, WriterTo interfaces can give some better performance,
+// but we skip that for now, they're optional interfaces
+// TO Add  Read, Write, (CloseRead, CloseWrite)
+// ReadFrom, WriteTo,
+
+// nopStop is the release function for deadlines that need no timer.
+func nopStop() {}
+
+// mkTimer returns a channel that fires when the deadline expires, along
+// with a function that releases the underlying timer.  The release function
+// must be called once the caller stops waiting, otherwise the timer lingers
+// until it fires, which adds up quickly in a busy Read or Write loop.
+func mkTimer(deadline time.Time) (<-chan time.Time, func()) {
+
+	if deadline.IsZero() {
+		return nil, nopStop
 	}
 
-	dur := deadline.Sub(time.Now())
+	dur := deadline.Sub(now())
 	if dur < 0 {
 		// a closed channel never blocks
 		tm := make(chan time.Time)
 		close(tm)
-		return tm
+		return tm, nopStop
 	}
 
-	return time.After(dur)
+	tm := make(chan time.Time, 1)
+	stop := afterFunc(dur, func() { tm <- now() })
+	return tm, func() { stop() }
 }
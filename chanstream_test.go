@@ -23,7 +23,21 @@
 package chanstream
 
 import "testing"
+import "bufio"
 import "bytes"
+import "context"
+import "errors"
+import "fmt"
+import "io"
+import "log"
+import "math/rand"
+import "net"
+import "os"
+import "runtime"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
 
 func TestListenAndAccept(t *testing.T) {
 	name := "test1"
@@ -34,7 +48,9 @@ func TestListenAndAccept(t *testing.T) {
 		return
 	}
 	
+	done := make(chan bool)
 	go func() {
+		defer close(done)
 		t.Logf("Connecting")
 		client, err := DialChan(name)
 		if err != nil {
@@ -49,6 +65,7 @@ func TestListenAndAccept(t *testing.T) {
 		t.Errorf("Accept failed: %v", err)
 	}
 	t.Logf("Connected server: %s (client %s)", server.LocalAddr(), server.RemoteAddr())
+	<-done
 }
 
 func TestDuplicateListen(t *testing.T) {
@@ -120,7 +137,7 @@ func TestEcho(t *testing.T) {
 		rep := make([]byte, len(req))
 		n, err = client.Read(rep)
 		if n != len(rep) {
-			t.Errorf("Client receive error: %n, %v", n, err)
+			t.Errorf("Client receive error: %d, %v", n, err)
 			return
 		}
 
@@ -140,7 +157,7 @@ func TestEcho(t *testing.T) {
 	// Now we can try to send and receive
 	n, err := server.Read(rcv)
 	if n != len(master) {
-		t.Errorf("Server received too few bytes: %n, %v", n, err)
+		t.Errorf("Server received too few bytes: %d, %v", n, err)
 		return
 	}
 	t.Logf("Server received %d bytes, err %v", n, err)
@@ -153,9 +170,4051 @@ func TestEcho(t *testing.T) {
 	copy(rep, rcv)
 	n, err = server.Write(rep)
 	if n != len(rep) {
-		t.Errorf("Server sent too few bytes: %n, %v", n, err)
+		t.Errorf("Server sent too few bytes: %d, %v", n, err)
 		return
 	}
 	t.Logf("Server replied with %d bytes", len(rep))
 
 }
+
+// mkPair establishes a listener on name, and returns a connected client
+// and server pair.
+func mkPair(t testing.TB, name string) (*ChanConn, *ChanConn) {
+	listener, err := ListenChan(name)
+	if err != nil {
+		t.Fatalf("ListenChan failed: %v", err)
+	}
+	dialed := make(chan *ChanConn)
+	go func() {
+		client, err := DialChan(name)
+		if err != nil {
+			t.Errorf("DialChan failed: %v", err)
+		}
+		dialed <- client
+	}()
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Fatalf("AcceptChan failed: %v", err)
+	}
+	client := <-dialed
+	if client == nil {
+		t.FailNow()
+	}
+	return client, server
+}
+
+func TestFlush(t *testing.T) {
+	client, server := mkPair(t, "testFlush")
+
+	for i := 0; i < 5; i++ {
+		if _, err := client.Write([]byte{byte(i)}); err != nil {
+			t.Errorf("Write failed: %v", err)
+			return
+		}
+	}
+	if n := client.Buffered(); n != 5 {
+		t.Errorf("Expected 5 buffered messages, got %d", n)
+	}
+
+	go func() {
+		b := make([]byte, 1)
+		for i := 0; i < 5; i++ {
+			if _, err := server.Read(b); err != nil {
+				t.Errorf("Read failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	if err := client.Flush(); err != nil {
+		t.Errorf("Flush failed: %v", err)
+		return
+	}
+	if n := client.Buffered(); n != 0 {
+		t.Errorf("Expected no buffered messages after Flush, got %d", n)
+	}
+}
+
+func TestFlushTimeoutPeerClosed(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+
+	client.Write([]byte("x"))
+	client.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if err := client.Flush(); err != ErrWrTimeout {
+		t.Errorf("Expected ErrWrTimeout from a stalled peer, got %v", err)
+	}
+
+	// A peer that closed, but may still drain what it was sent, is not
+	// merely stalled.
+	server.CloseReadGraceful(0)
+	for !server.readClosed() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := client.Flush(); err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed from a closed peer, got %v", err)
+	}
+	server.Close()
+}
+
+func TestUndelivered(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := client.Write([]byte{byte(i)}); err != nil {
+			t.Errorf("Failed to write: %v", err)
+			return
+		}
+	}
+	server.Read(make([]byte, 1))
+	if n := client.UndeliveredCount(); n != 0 {
+		t.Errorf("Undelivered %d while the peer is reading", n)
+	}
+
+	server.CloseRead()
+	if n := client.UndeliveredCount(); n != 4 {
+		t.Errorf("Expected 4 undelivered, got %d", n)
+	}
+	if err := client.Flush(); err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed from Flush, got %v", err)
+	}
+	if _, err := client.Write([]byte("more")); err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed from Write, got %v", err)
+	}
+}
+
+func TestOnAccept(t *testing.T) {
+	name := "testOnAccept"
+	listener, err := ListenChan(name)
+	if err != nil {
+		t.Errorf("ListenChan failed: %v", err)
+		return
+	}
+	var hooked *ChanConn
+	listener.OnAccept = func(c *ChanConn) {
+		hooked = c
+	}
+
+	go func() {
+		if _, err := DialChan(name); err != nil {
+			t.Errorf("DialChan failed: %v", err)
+		}
+	}()
+
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("AcceptChan failed: %v", err)
+		return
+	}
+	if hooked != server {
+		t.Errorf("OnAccept not called with accepted connection")
+	}
+}
+
+func TestDeadlineTimersReleased(t *testing.T) {
+	fc := newFakeClock()
+	defer SetClock(SetClock(fc))
+	client, server := mkPair(t, "testDeadlineTimers")
+
+	b := make([]byte, 1)
+	for i := 0; i < 1000; i++ {
+		server.SetReadDeadline(fc.Now().Add(time.Hour))
+		client.SetWriteDeadline(fc.Now().Add(time.Hour))
+		wrote := make(chan error, 1)
+		go func() {
+			// Make every other Read wait, and so start a timer.
+			if i%2 == 0 {
+				fc.waitTimers(1)
+			}
+			_, err := client.Write(make([]byte, 1))
+			wrote <- err
+		}()
+		if _, err := server.Read(b); err != nil {
+			t.Errorf("Read failed: %v", err)
+			return
+		}
+		if err := <-wrote; err != nil {
+			t.Errorf("Write failed: %v", err)
+			return
+		}
+	}
+	fc.mtx.Lock()
+	created := len(fc.timers)
+	fc.mtx.Unlock()
+	if created == 0 {
+		t.Errorf("No deadline timers were started")
+	}
+	if n := fc.pending(); n > 0 {
+		t.Errorf("%d of %d deadline timers were never stopped", n, created)
+	}
+}
+
+func BenchmarkDeadlineRead(b *testing.B) {
+	client, server := mkPair(b, fmt.Sprintf("benchDeadlineRead.%d", b.N))
+	msg := make([]byte, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server.SetReadDeadline(time.Now().Add(time.Hour))
+		client.Write(msg)
+		server.Read(msg)
+	}
+}
+
+func TestReadPeerCloseWrite(t *testing.T) {
+	client, server := mkPair(t, "testReadPeerCloseWrite")
+
+	client.CloseWrite()
+	b := make([]byte, 10)
+	if n, err := server.Read(b); n != 0 || err != io.EOF {
+		t.Errorf("Expected EOF, got %d, %v", n, err)
+	}
+}
+
+func TestReadLocalClose(t *testing.T) {
+	_, server := mkPair(t, "testReadLocalClose")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		server.Close()
+	}()
+	b := make([]byte, 10)
+	if n, err := server.Read(b); n != 0 || err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed for blocked Read, got %d, %v", n, err)
+	}
+	if n, err := server.Read(b); n != 0 || err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed after close, got %d, %v", n, err)
+	}
+}
+
+func TestReadBufferCoalesce(t *testing.T) {
+	client, server := mkPair(t, "testReadBufferCoalesce")
+
+	for i := 0; i < 4; i++ {
+		client.Write([]byte{byte(i), byte(i)})
+	}
+	server.SetReadBuffer(6)
+	b := make([]byte, 64)
+	if n, err := server.Read(b); n != 6 || err != nil {
+		t.Errorf("Expected 6 coalesced bytes, got %d, %v", n, err)
+	}
+	if n, err := server.Read(b); n != 2 || err != nil {
+		t.Errorf("Expected 2 remaining bytes, got %d, %v", n, err)
+	}
+	if !bytes.Equal(b[:2], []byte{3, 3}) {
+		t.Errorf("Data mismatch: %v", b[:2])
+	}
+}
+
+func benchmarkReadBuffer(b *testing.B, size int) {
+	client, server := mkPair(b, fmt.Sprintf("benchReadBuffer.%d.%d", size, b.N))
+	server.SetReadBuffer(size)
+	msg := make([]byte, 16)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			client.Write(msg)
+		}
+		client.CloseWrite()
+	}()
+
+	buf := make([]byte, 4096)
+	reads := 0
+	b.ResetTimer()
+	for {
+		if _, err := server.Read(buf); err != nil {
+			break
+		}
+		reads++
+	}
+	b.ReportMetric(float64(b.N)/float64(reads), "msgs/read")
+}
+
+func BenchmarkReadBufferNone(b *testing.B) {
+	benchmarkReadBuffer(b, 0)
+}
+
+func BenchmarkReadBuffer4K(b *testing.B) {
+	benchmarkReadBuffer(b, 4096)
+}
+
+func TestErrorKind(t *testing.T) {
+	kinds := map[*ChanError]ErrorKind{
+		ErrConnRefused:   KindRefused,
+		ErrAddrInUse:     KindAddrInUse,
+		ErrAcceptTimeout: KindTimeout,
+		ErrListenQFull:   KindQueueFull,
+		ErrConnClosed:    KindClosed,
+		ErrConnTimeout:   KindTimeout,
+		ErrRdTimeout:     KindTimeout,
+		ErrWrTimeout:     KindTimeout,
+	}
+	for err, kind := range kinds {
+		if err.Kind() != kind {
+			t.Errorf("%v: expected kind %d, got %d", err, kind, err.Kind())
+		}
+	}
+
+	wrapped := fmt.Errorf("reading reply: %w", ErrRdTimeout)
+	if !errors.Is(wrapped, ErrRdTimeout) {
+		t.Errorf("errors.Is failed to match wrapped error")
+	}
+	if errors.Is(wrapped, ErrWrTimeout) {
+		t.Errorf("errors.Is matched the wrong error")
+	}
+	var ce *ChanError
+	if !errors.As(wrapped, &ce) || ce.Kind() != KindTimeout {
+		t.Errorf("errors.As failed to find timeout ChanError")
+	}
+}
+
+func TestEphemeralListen(t *testing.T) {
+	l1, err := ListenChan("")
+	if err != nil {
+		t.Errorf("ListenChan failed: %v", err)
+		return
+	}
+	l2, err := ListenChan("")
+	if err != nil {
+		t.Errorf("ListenChan failed: %v", err)
+		return
+	}
+	if l1.Addr().String() == l2.Addr().String() {
+		t.Errorf("Ephemeral names collide: %s", l1.Addr())
+		return
+	}
+
+	for _, l := range []*ChanListener{l1, l2} {
+		go func(name string) {
+			if _, err := DialChan(name); err != nil {
+				t.Errorf("DialChan %s failed: %v", name, err)
+			}
+		}(l.Addr().String())
+		server, err := l.AcceptChan()
+		if err != nil {
+			t.Errorf("AcceptChan failed: %v", err)
+			return
+		}
+		if server.LocalAddr().String() != l.Addr().String() {
+			t.Errorf("Address mismatch: %s != %s", server.LocalAddr(), l.Addr())
+		}
+	}
+}
+
+func TestDialMeta(t *testing.T) {
+	name := "testDialMeta"
+	listener, err := ListenChan(name)
+	if err != nil {
+		t.Errorf("ListenChan failed: %v", err)
+		return
+	}
+
+	go func() {
+		if _, err := DialChanMeta(name, []byte("v2")); err != nil {
+			t.Errorf("DialChanMeta failed: %v", err)
+		}
+	}()
+	_, meta, err := listener.AcceptChanMeta()
+	if err != nil {
+		t.Errorf("AcceptChanMeta failed: %v", err)
+		return
+	}
+	if string(meta) != "v2" {
+		t.Errorf("Expected meta v2, got %q", meta)
+	}
+
+	go func() {
+		if _, err := DialChan(name); err != nil {
+			t.Errorf("DialChan failed: %v", err)
+		}
+	}()
+	_, meta, err = listener.AcceptChanMeta()
+	if err != nil {
+		t.Errorf("AcceptChanMeta failed: %v", err)
+		return
+	}
+	if meta != nil {
+		t.Errorf("Expected nil meta, got %q", meta)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	client, server := mkPair(t, "testHalfClose")
+
+	client.Write([]byte("request"))
+	client.CloseWrite()
+	client.CloseWrite() // harmless
+	if _, err := client.Write([]byte("more")); err != ErrConnClosed {
+		t.Errorf("Write after CloseWrite: expected ErrConnClosed, got %v", err)
+	}
+
+	go func() {
+		b := make([]byte, 64)
+		for {
+			if _, err := server.Read(b); err != nil {
+				if err != io.EOF {
+					t.Errorf("Server expected EOF, got %v", err)
+				}
+				break
+			}
+		}
+		server.Write([]byte("response, "))
+		server.Write([]byte("in parts"))
+		server.Close()
+	}()
+
+	var reply []byte
+	b := make([]byte, 64)
+	for {
+		n, err := client.Read(b)
+		reply = append(reply, b[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Errorf("Client Read failed: %v", err)
+			return
+		}
+	}
+	if string(reply) != "response, in parts" {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	client.Close()
+}
+
+func TestIsClosed(t *testing.T) {
+	client, server := mkPair(t, "testIsClosed")
+
+	if client.IsClosed() || server.IsClosed() {
+		t.Errorf("New connection reports closed")
+	}
+	client.Close()
+	if !client.IsClosed() {
+		t.Errorf("Closed connection reports open")
+	}
+	if !server.IsClosed() {
+		t.Errorf("Connection with closed peer reports open")
+	}
+}
+
+func TestWriteBuffers(t *testing.T) {
+	client, server := mkPair(t, "testWriteBuffers")
+
+	bufs := net.Buffers{[]byte("one,"), []byte("two,"), []byte("three")}
+	n, err := client.WriteBuffers(&bufs)
+	if n != 13 || err != nil {
+		t.Errorf("WriteBuffers: got %d, %v", n, err)
+		return
+	}
+	if len(bufs) != 0 {
+		t.Errorf("WriteBuffers left %d buffers", len(bufs))
+	}
+	if client.Buffered() != 1 {
+		t.Errorf("Expected a single message, got %d", client.Buffered())
+	}
+	b := make([]byte, 64)
+	m, _ := server.Read(b)
+	if string(b[:m]) != "one,two,three" {
+		t.Errorf("Unexpected data %q", b[:m])
+	}
+}
+
+func BenchmarkWriteSmall(b *testing.B) {
+	client, server := mkPair(b, fmt.Sprintf("benchWriteSmall.%d", b.N))
+	go io.Copy(io.Discard, server)
+	small := make([]byte, 8)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 16; j++ {
+			client.Write(small)
+		}
+	}
+}
+
+func BenchmarkWriteBuffers(b *testing.B) {
+	client, server := mkPair(b, fmt.Sprintf("benchWriteBuffers.%d", b.N))
+	go io.Copy(io.Discard, server)
+	small := make([]byte, 8)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bufs := make(net.Buffers, 16)
+		for j := range bufs {
+			bufs[j] = small
+		}
+		client.WriteBuffers(&bufs)
+	}
+}
+
+func TestResetRegistry(t *testing.T) {
+	names := []string{"testReset1", "testReset2", "testReset3"}
+	var lst []*ChanListener
+	for _, name := range names {
+		l, err := ListenChan(name)
+		if err != nil {
+			t.Errorf("ListenChan failed: %v", err)
+			return
+		}
+		lst = append(lst, l)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := lst[0].AcceptChan()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ResetRegistry()
+	if err := <-done; err != ErrListenerClosed {
+		t.Errorf("Blocked AcceptChan: expected ErrListenerClosed, got %v", err)
+	}
+	if _, err := lst[1].AcceptChan(); err != ErrListenerClosed {
+		t.Errorf("AcceptChan: expected ErrListenerClosed, got %v", err)
+	}
+	for _, name := range names {
+		l, err := ListenChan(name)
+		if err != nil {
+			t.Errorf("Name %s not reusable: %v", name, err)
+			continue
+		}
+		l.Close()
+	}
+}
+
+func TestAcceptDeadline(t *testing.T) {
+	listener, err := ListenChan("testAcceptDeadline")
+	if err != nil {
+		t.Errorf("ListenChan failed: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	listener.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	if _, err := listener.AcceptChan(); err != ErrAcceptTimeout {
+		t.Errorf("Expected ErrAcceptTimeout, got %v", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Accept timed out early, after %v", d)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	producer, consumer := mkPair(t, "testMirror")
+	m1, r1 := mkPair(t, "testMirror1")
+	m2, r2 := mkPair(t, "testMirror2")
+	consumer.Mirror(m1)
+	consumer.Mirror(m2)
+
+	var stream []byte
+	for i := 0; i < 20; i++ {
+		stream = append(stream, fmt.Sprintf("message %d;", i)...)
+	}
+	go func() {
+		for i := 0; i < len(stream); i += 7 {
+			end := i + 7
+			if end > len(stream) {
+				end = len(stream)
+			}
+			producer.Write(stream[i:end])
+		}
+		producer.Close()
+	}()
+
+	results := make(chan []byte, 2)
+	drain := func(c *ChanConn) {
+		buf := make([]byte, len(stream))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Errorf("Mirror read failed: %v", err)
+		}
+		results <- buf
+	}
+	go drain(r1)
+	go drain(r2)
+
+	orig, err := io.ReadAll(consumer)
+	if err != nil {
+		t.Errorf("Read failed: %v", err)
+		return
+	}
+	if !bytes.Equal(orig, stream) {
+		t.Errorf("Stream mismatch: %q != %q", orig, stream)
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-results; !bytes.Equal(got, stream) {
+			t.Errorf("Mirror mismatch: %q != %q", got, stream)
+		}
+	}
+}
+
+func TestListenContext(t *testing.T) {
+	name := "testListenContext"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := ListenChanContext(ctx, name)
+	if err != nil {
+		t.Errorf("ListenChanContext failed: %v", err)
+		return
+	}
+	cancel()
+	if _, err := listener.AcceptChan(); err != ErrListenerClosed {
+		t.Errorf("Expected ErrListenerClosed, got %v", err)
+	}
+	listener, err = ListenChan(name)
+	if err != nil {
+		t.Errorf("Name not released: %v", err)
+		return
+	}
+	listener.Close()
+}
+
+func TestMessageMode(t *testing.T) {
+	client, server := mkPair(t, "testMessageMode")
+
+	client.Write([]byte("first"))
+	client.Write([]byte("second"))
+	server.SetReadBuffer(1024)
+	server.SetMessageMode(true)
+
+	b := make([]byte, 64)
+	for _, want := range []string{"first", "second"} {
+		n, err := server.Read(b)
+		if err != nil {
+			t.Errorf("Read failed: %v", err)
+			return
+		}
+		if string(b[:n]) != want {
+			t.Errorf("Expected %q, got %q", want, b[:n])
+		}
+	}
+}
+
+func TestReadTimeoutRetry(t *testing.T) {
+	client, server := mkPair(t, "testReadTimeoutRetry")
+
+	client.Write([]byte("abcdef"))
+	b := make([]byte, 3)
+	if n, err := server.Read(b); n != 3 || err != nil {
+		t.Errorf("Read failed: %d, %v", n, err)
+		return
+	}
+	server.Read(b) // consume "def"
+
+	server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := server.Read(b); err != ErrRdTimeout {
+		t.Errorf("Expected ErrRdTimeout, got %v", err)
+	} else if !err.(net.Error).Temporary() {
+		t.Errorf("Read timeout should be temporary")
+	}
+
+	client.Write([]byte("xyz"))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := server.Read(b); n != 3 || err != nil || string(b) != "xyz" {
+		t.Errorf("Retry failed: %d, %v, %q", n, err, b[:n])
+	}
+}
+
+func TestWriteTimeoutNotDelivered(t *testing.T) {
+	client, server := mkPair(t, "testWriteTimeoutNotDelivered")
+
+	for client.Buffered() < cap(client.fifo) {
+		client.Write([]byte{1})
+	}
+	client.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := client.Write([]byte{2}); err != ErrWrTimeout {
+		t.Errorf("Expected ErrWrTimeout, got %v", err)
+	}
+	client.CloseWrite()
+
+	b := make([]byte, 1)
+	for {
+		if _, err := server.Read(b); err != nil {
+			break
+		}
+		if b[0] != 1 {
+			t.Errorf("Timed out write was delivered")
+		}
+	}
+}
+
+func TestEmptyMessage(t *testing.T) {
+	client, server := mkPair(t, "testEmptyMessage")
+
+	client.Write([]byte{})
+	client.Write([]byte("data"))
+	b := make([]byte, 64)
+	if n, err := server.Read(b); err != nil || string(b[:n]) != "data" {
+		t.Errorf("Stream mode: expected data, got %d, %v", n, err)
+	}
+
+	server.SetMessageMode(true)
+	client.Write([]byte{})
+	client.Write([]byte("data"))
+	if n, err := server.Read(b); n != 0 || err != nil {
+		t.Errorf("Message mode: expected empty message, got %d, %v", n, err)
+	}
+	if n, err := server.Read(b); err != nil || string(b[:n]) != "data" {
+		t.Errorf("Message mode: expected data, got %d, %v", n, err)
+	}
+}
+
+func TestActiveConns(t *testing.T) {
+	listener, err := ListenChan("activeconns")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	var clients, servers []*ChanConn
+	for i := 0; i < 2; i++ {
+		dialed := make(chan *ChanConn)
+		go func() {
+			client, _ := DialChan("activeconns")
+			dialed <- client
+		}()
+		server, err := listener.AcceptChan()
+		if err != nil {
+			t.Errorf("Failed to accept: %v", err)
+			return
+		}
+		clients = append(clients, <-dialed)
+		servers = append(servers, server)
+	}
+	if n := listener.ActiveConns(); n != 2 {
+		t.Errorf("Expected 2 active connections, got %d", n)
+	}
+	// Either end closing finishes the connection.
+	clients[0].Close()
+	servers[1].Close()
+	if n := listener.ActiveConns(); n != 0 {
+		t.Errorf("Expected no active connections, got %d", n)
+	}
+	servers[0].Close()
+	clients[1].Close()
+	if n := listener.ActiveConns(); n != 0 {
+		t.Errorf("Closing again changed the count to %d", n)
+	}
+}
+
+func TestQueueLen(t *testing.T) {
+	name := "testQueueLen"
+	listener, err := ListenChan(name)
+	if err != nil {
+		t.Errorf("ListenChan failed: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	if listener.QueueCap() == 0 {
+		t.Errorf("Listener has no backlog")
+	}
+	for i := 1; i <= 3; i++ {
+		go DialChan(name)
+		for start := time.Now(); listener.QueueLen() < i; {
+			if time.Since(start) > time.Second {
+				t.Errorf("QueueLen stuck at %d", listener.QueueLen())
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	listener.AcceptChan()
+	if n := listener.QueueLen(); n != 2 {
+		t.Errorf("Expected QueueLen 2 after Accept, got %d", n)
+	}
+}
+
+func TestDone(t *testing.T) {
+	client, server := mkPair(t, "testDone")
+
+	done := server.Done()
+	select {
+	case <-done:
+		t.Errorf("Done fired before close")
+		return
+	default:
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		client.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Done did not fire on peer close")
+	}
+	if server.Done() != done {
+		t.Errorf("Done returned a different channel")
+	}
+}
+
+func TestReject(t *testing.T) {
+	name := "testReject"
+	listener, err := ListenChan(name)
+	if err != nil {
+		t.Errorf("ListenChan failed: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := DialChan(name)
+		done <- err
+	}()
+	for listener.QueueLen() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	listener.Reject()
+	select {
+	case err := <-done:
+		if err != ErrConnClosed {
+			t.Errorf("Expected ErrConnClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Dialer not released by Reject")
+	}
+	t.Logf("Dialer released after %v", time.Since(start))
+}
+
+func TestReadFull(t *testing.T) {
+	client, server := mkPair(t, "testReadFull")
+
+	client.Write([]byte("hello, "))
+	client.Write([]byte("world"))
+	b := make([]byte, 12)
+	if n, err := server.ReadFull(b); n != 12 || err != nil {
+		t.Errorf("ReadFull failed: %d, %v", n, err)
+	} else if string(b) != "hello, world" {
+		t.Errorf("Unexpected data %q", b)
+	}
+
+	client.Write([]byte("abc"))
+	server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if n, err := server.ReadFull(b); n != 3 || err != ErrRdTimeout {
+		t.Errorf("Expected 3, ErrRdTimeout, got %d, %v", n, err)
+	}
+	server.SetReadDeadline(time.Time{})
+
+	client.Write([]byte("abc"))
+	client.CloseWrite()
+	if n, err := server.ReadFull(b); n != 3 || err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected 3, ErrUnexpectedEOF, got %d, %v", n, err)
+	}
+}
+
+func TestPipeChanSync(t *testing.T) {
+	c1, c2 := PipeChanSync()
+
+	wrote := make(chan bool)
+	go func() {
+		c1.Write([]byte("rendezvous"))
+		close(wrote)
+	}()
+
+	select {
+	case <-wrote:
+		t.Errorf("Write returned before the peer read")
+		return
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	b := make([]byte, 64)
+	n, err := c2.Read(b)
+	if err != nil || string(b[:n]) != "rendezvous" {
+		t.Errorf("Read failed: %d, %v", n, err)
+	}
+	select {
+	case <-wrote:
+	case <-time.After(time.Second):
+		t.Errorf("Write did not complete after the peer read")
+	}
+}
+
+func TestPeek(t *testing.T) {
+	c1, c2 := PipeChan()
+
+	c1.Write([]byte("GE"))
+	c1.Write([]byte("T /index"))
+	p, err := c2.Peek(4)
+	if err != nil || string(p) != "GET " {
+		t.Errorf("Peek failed: %q, %v", p, err)
+		return
+	}
+
+	b := make([]byte, 64)
+	n, err := c2.ReadFull(b[:10])
+	if err != nil || string(b[:n]) != "GET /index" {
+		t.Errorf("Read after Peek got %q, %v", b[:n], err)
+	}
+
+	c1.Write([]byte("ab"))
+	c2.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if p, err := c2.Peek(4); err != ErrRdTimeout || string(p) != "ab" {
+		t.Errorf("Expected partial peek and timeout, got %q, %v", p, err)
+	}
+	if p, err := c2.Peek(-1); err != bufio.ErrNegativeCount || p != nil {
+		t.Errorf("Expected ErrNegativeCount, got %q, %v", p, err)
+	}
+}
+
+func TestPeekMessageMode(t *testing.T) {
+	c1, c2 := PipeChan()
+	defer c1.Close()
+	defer c2.Close()
+
+	c2.SetMessageMode(true)
+	c1.Write([]byte("ab"))
+	c1.Write([]byte("cd"))
+	if p, err := c2.Peek(4); err != nil || string(p) != "ab" {
+		t.Errorf("Expected a peek of one message, got %q, %v", p, err)
+	}
+	b := make([]byte, 10)
+	for _, want := range []string{"ab", "cd"} {
+		if n, err := c2.Read(b); err != nil || string(b[:n]) != want {
+			t.Errorf("Unexpected read %q, %v, expected %q", b[:n], err, want)
+		}
+	}
+}
+
+func TestWriteString(t *testing.T) {
+	c1, c2 := PipeChan()
+
+	if n, err := io.WriteString(c1, "text"); n != 4 || err != nil {
+		t.Errorf("WriteString failed: %d, %v", n, err)
+	}
+	b := make([]byte, 64)
+	if n, _ := c2.Read(b); string(b[:n]) != "text" {
+		t.Errorf("Unexpected data %q", b[:n])
+	}
+}
+
+var benchString = "a moderately long line of text, as a text protocol might send\r\n"
+
+func BenchmarkWriteString(b *testing.B) {
+	c1, c2 := PipeChan()
+	go io.Copy(io.Discard, c2)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c1.WriteString(benchString)
+	}
+}
+
+func BenchmarkWriteStringBytes(b *testing.B) {
+	c1, c2 := PipeChan()
+	go io.Copy(io.Discard, c2)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c1.Write([]byte(benchString))
+	}
+}
+
+func TestAcceptCheck(t *testing.T) {
+	name := "testAcceptCheck"
+	listener, err := ListenChan(name)
+	if err != nil {
+		t.Errorf("ListenChan failed: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	errVersion := errors.New("unsupported protocol version")
+	done := make(chan error)
+	go func() {
+		_, err := DialChanMeta(name, []byte("v1"))
+		done <- err
+	}()
+
+	conn, meta, err := listener.AcceptChanCheck(func(meta []byte) error {
+		if string(meta) != "v2" {
+			return errVersion
+		}
+		return nil
+	})
+	if conn != nil || err != errVersion || string(meta) != "v1" {
+		t.Errorf("Expected rejection, got %v, %q, %v", conn, meta, err)
+	}
+	if err := <-done; err != errVersion {
+		t.Errorf("Dialer expected rejection error, got %v", err)
+	}
+}
+
+func TestWriteWaitsForSpace(t *testing.T) {
+	c1, c2 := PipeChan()
+
+	for c1.Buffered() < cap(c1.fifo) {
+		c1.Write([]byte{1})
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c2.Read(make([]byte, 1))
+	}()
+
+	c1.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := c1.Write([]byte{2}); err != nil {
+		t.Errorf("Write did not wait for space: %v", err)
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	client, server := mkPair(t, "testAddresses")
+
+	if s := server.LocalAddr().String(); s != "testAddresses" {
+		t.Errorf("Server local address %q", s)
+	}
+	if s := client.RemoteAddr().String(); s != "testAddresses" {
+		t.Errorf("Client remote address %q", s)
+	}
+	if client.LocalAddr().String() == server.LocalAddr().String() {
+		t.Errorf("Client and server addresses are the same")
+	}
+	if client.LocalAddr().String() != server.RemoteAddr().String() {
+		t.Errorf("Client address %s, server sees %s",
+			client.LocalAddr(), server.RemoteAddr())
+	}
+	t.Logf("Client %s <-> server %s", client.LocalAddr(), server.LocalAddr())
+}
+
+func TestDeadlineFromContext(t *testing.T) {
+	c1, _ := PipeChan()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c1.SetDeadlineFromContext(ctx)
+
+	start := time.Now()
+	if _, err := c1.Read(make([]byte, 1)); err != ErrRdTimeout {
+		t.Errorf("Expected ErrRdTimeout, got %v", err)
+	}
+	if d := time.Since(start); d < 15*time.Millisecond || d > time.Second {
+		t.Errorf("Read timed out after %v", d)
+	}
+
+	c1.SetDeadlineFromContext(context.Background())
+	if !c1.rdeadline.IsZero() || !c1.wdeadline.IsZero() {
+		t.Errorf("Deadlines not cleared")
+	}
+}
+
+func TestDeadlockWarning(t *testing.T) {
+	var logbuf bytes.Buffer
+	log.SetOutput(&logbuf)
+	defer log.SetOutput(os.Stderr)
+	deadlockWarnings.after = 10 * time.Millisecond
+	EnableDeadlockWarnings(true)
+	defer func() {
+		EnableDeadlockWarnings(false)
+		deadlockWarnings.after = 0
+	}()
+
+	c1, _ := PipeChanSync()
+	c1.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c1.Write([]byte("stuck")); err != ErrWrTimeout {
+		t.Errorf("Expected ErrWrTimeout, got %v", err)
+	}
+	if !strings.Contains(logbuf.String(), "blocked") {
+		t.Errorf("No warning logged for stuck write: %q", logbuf.String())
+	}
+}
+
+func TestPeerWriteClosed(t *testing.T) {
+	c1, c2 := PipeChan()
+
+	c1.Write([]byte("one"))
+	c1.Write([]byte("two"))
+	if c2.PeerWriteClosed() {
+		t.Errorf("PeerWriteClosed before close")
+	}
+	c1.CloseWrite()
+
+	b := make([]byte, 2)
+	for !c2.PeerWriteClosed() {
+		if _, err := c2.Read(b); err != nil {
+			t.Errorf("Read failed before drained: %v", err)
+			return
+		}
+	}
+	if _, err := c2.Read(b); err != io.EOF {
+		t.Errorf("Expected EOF once drained, got %v", err)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	c1, c2 := PipeChan()
+	pool := &sync.Pool{}
+	c1.SetBufferPool(pool)
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			c1.Write(bytes.Repeat([]byte{byte(i)}, 1+i%100))
+		}
+		c1.Close()
+	}()
+	b := make([]byte, 128)
+	for i := 0; i < 1000; i++ {
+		want := bytes.Repeat([]byte{byte(i)}, 1+i%100)
+		if _, err := c2.ReadFull(b[:len(want)]); err != nil {
+			t.Errorf("Read failed: %v", err)
+			return
+		}
+		if !bytes.Equal(b[:len(want)], want) {
+			t.Errorf("Message %d corrupted: %v", i, b[:len(want)])
+			return
+		}
+	}
+}
+
+func TestBufferPoolStress(t *testing.T) {
+	n := 1000000
+	if testing.Short() {
+		n = 50000
+	}
+	c1, c2 := PipeChan()
+	defer c2.Close()
+	pool := &sync.Pool{New: func() interface{} { return make([]byte, 0, 64) }}
+	c1.SetBufferPool(pool)
+	// Some messages are split, so that chunks are recycled too.
+	c1.SetMaxMessageSize(24, true)
+
+	msg := func(i int) []byte {
+		b := make([]byte, 1+i%37)
+		for j := range b {
+			b[j] = byte(i + j)
+		}
+		return b
+	}
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := c1.Write(msg(i)); err != nil {
+				return
+			}
+		}
+		c1.Close()
+	}()
+
+	// Reads of odd sizes straddle the messages.
+	r := bufio.NewReaderSize(c2, 16)
+	for i := 0; i < n; i++ {
+		want := msg(i)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Errorf("Read failed: %v", err)
+			return
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Message %d corrupted: %v", i, got)
+			return
+		}
+	}
+}
+
+func benchmarkBufferPool(b *testing.B, pool *sync.Pool) {
+	c1, c2 := PipeChan()
+	c1.SetBufferPool(pool)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := c2.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	msg := make([]byte, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c1.Write(msg)
+	}
+	c1.Close()
+}
+
+func BenchmarkBufferNoPool(b *testing.B) {
+	benchmarkBufferPool(b, nil)
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	benchmarkBufferPool(b, &sync.Pool{})
+}
+
+// The following tests check that ChanConn behaves as a net.Conn ought to,
+// in the spirit of the nettest.TestConn suite.
+
+// aLongTimeAgo is a deadline that has certainly expired.
+var aLongTimeAgo = time.Unix(233431200, 0)
+
+func TestConnCompliance(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, *ChanConn, *ChanConn)
+	}{
+		{"BasicIO", testConnBasicIO},
+		{"PingPong", testConnPingPong},
+		{"HalfClose", testConnHalfClose},
+		{"RacyRead", testConnRacyRead},
+		{"RacyWrite", testConnRacyWrite},
+		{"ReadTimeout", testConnReadTimeout},
+		{"WriteTimeout", testConnWriteTimeout},
+		{"PastTimeout", testConnPastTimeout},
+		{"PresentTimeout", testConnPresentTimeout},
+		{"FutureTimeout", testConnFutureTimeout},
+		{"CloseTimeout", testConnCloseTimeout},
+		{"RacyClose", testConnRacyClose},
+		{"ConcurrentMethods", testConnConcurrentMethods},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := PipeChan()
+			defer c1.Close()
+			defer c2.Close()
+			var _ net.Conn = c1
+			tt.fn(t, c1, c2)
+		})
+	}
+}
+
+// chunkedCopy copies from src to dst using randomly sized buffers.
+func chunkedCopy(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, 1024)
+	for {
+		n, err := src.Read(buf[:1+rand.Intn(len(buf))])
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkTimeoutError reports an error unless err is a net.Error timeout.
+func checkTimeoutError(t *testing.T, err error) {
+	t.Helper()
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+}
+
+// writeUntilError writes to c until an error occurs, returning it.
+func writeUntilError(c *ChanConn) error {
+	buf := make([]byte, 1024)
+	for {
+		if _, err := c.Write(buf); err != nil {
+			return err
+		}
+	}
+}
+
+func testConnBasicIO(t *testing.T, c1, c2 *ChanConn) {
+	want := make([]byte, 1<<18)
+	rand.Read(want)
+
+	go func() {
+		if err := chunkedCopy(c1, bytes.NewReader(want)); err != nil {
+			t.Errorf("Unexpected write error: %v", err)
+		}
+		c1.CloseWrite()
+	}()
+
+	var got bytes.Buffer
+	if err := chunkedCopy(&got, c2); err != nil {
+		t.Errorf("Unexpected read error: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("Transmitted data differs")
+	}
+}
+
+func testConnPingPong(t *testing.T, c1, c2 *ChanConn) {
+	pingPong := func(c *ChanConn, first bool, done chan bool) {
+		defer close(done)
+		b := make([]byte, 8)
+		var prev uint64
+		if first {
+			b[7] = 1
+			c.Write(b)
+		}
+		for {
+			if _, err := c.ReadFull(b); err != nil {
+				if err != io.EOF {
+					t.Errorf("Unexpected read error: %v", err)
+				}
+				return
+			}
+			v := uint64(0)
+			for _, x := range b {
+				v = v<<8 | uint64(x)
+			}
+			if prev != 0 && v != prev+2 {
+				t.Errorf("Mismatched value: %d after %d", v, prev)
+				return
+			}
+			prev = v
+			if v >= 1000 {
+				c.CloseWrite()
+				return
+			}
+			v++
+			for i := 7; i >= 0; i-- {
+				b[i] = byte(v)
+				v >>= 8
+			}
+			if _, err := c.Write(b); err != nil {
+				t.Errorf("Unexpected write error: %v", err)
+				return
+			}
+		}
+	}
+	d1 := make(chan bool)
+	d2 := make(chan bool)
+	go pingPong(c1, true, d1)
+	go pingPong(c2, false, d2)
+	<-d1
+	<-d2
+}
+
+func testConnHalfClose(t *testing.T, c1, c2 *ChanConn) {
+	c1.Write([]byte("question"))
+	c1.CloseWrite()
+
+	got, err := io.ReadAll(c2)
+	if err != nil || string(got) != "question" {
+		t.Errorf("Unexpected request %q, %v", got, err)
+	}
+	c2.Write([]byte("answer"))
+	c2.CloseWrite()
+	got, err = io.ReadAll(c1)
+	if err != nil || string(got) != "answer" {
+		t.Errorf("Unexpected reply %q, %v", got, err)
+	}
+}
+
+func testConnRacyRead(t *testing.T, c1, c2 *ChanConn) {
+	go chunkedCopy(c2, rand.New(rand.NewSource(0)))
+
+	var wg sync.WaitGroup
+	c1.SetReadDeadline(time.Now().Add(time.Millisecond))
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b1 := make([]byte, 1024)
+			b2 := make([]byte, 1024)
+			for j := 0; j < 100; j++ {
+				_, err := c1.Read(b1)
+				copy(b1, b2) // Mutate b1 to trigger potential race
+				if err != nil {
+					checkTimeoutError(t, err)
+					c1.SetReadDeadline(time.Now().Add(time.Millisecond))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func testConnRacyWrite(t *testing.T, c1, c2 *ChanConn) {
+	go chunkedCopy(io.Discard, c2)
+
+	var wg sync.WaitGroup
+	c1.SetWriteDeadline(time.Now().Add(time.Millisecond))
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b1 := make([]byte, 1024)
+			b2 := make([]byte, 1024)
+			for j := 0; j < 100; j++ {
+				_, err := c1.Write(b1)
+				copy(b1, b2) // Mutate b1 to trigger potential race
+				if err != nil {
+					checkTimeoutError(t, err)
+					c1.SetWriteDeadline(time.Now().Add(time.Millisecond))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func testConnReadTimeout(t *testing.T, c1, c2 *ChanConn) {
+	go chunkedCopy(io.Discard, c2)
+
+	c1.SetReadDeadline(aLongTimeAgo)
+	_, err := c1.Read(make([]byte, 1024))
+	checkTimeoutError(t, err)
+}
+
+func testConnWriteTimeout(t *testing.T, c1, c2 *ChanConn) {
+	go chunkedCopy(c2, rand.New(rand.NewSource(0)))
+
+	c1.SetWriteDeadline(aLongTimeAgo)
+	_, err := c1.Write(make([]byte, 1024))
+	checkTimeoutError(t, err)
+}
+
+func testConnPastTimeout(t *testing.T, c1, c2 *ChanConn) {
+	go chunkedCopy(c2, c2)
+
+	c1.SetDeadline(aLongTimeAgo)
+	n, err := c1.Write(make([]byte, 1024))
+	if n != 0 {
+		t.Errorf("Unexpected amount of data written: %d", n)
+	}
+	checkTimeoutError(t, err)
+	n, err = c1.Read(make([]byte, 1024))
+	if n != 0 {
+		t.Errorf("Unexpected amount of data read: %d", n)
+	}
+	checkTimeoutError(t, err)
+}
+
+func testConnPresentTimeout(t *testing.T, c1, c2 *ChanConn) {
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	deadlineSet := make(chan bool, 1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(10 * time.Millisecond)
+		deadlineSet <- true
+		c1.SetReadDeadline(aLongTimeAgo)
+		c1.SetWriteDeadline(aLongTimeAgo)
+	}()
+	go func() {
+		defer wg.Done()
+		n, err := c1.Read(make([]byte, 1024))
+		if n != 0 {
+			t.Errorf("Unexpected amount of data read: %d", n)
+		}
+		checkTimeoutError(t, err)
+		if len(deadlineSet) == 0 {
+			t.Errorf("Read timed out before deadline is set")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		checkTimeoutError(t, writeUntilError(c1))
+		if len(deadlineSet) == 0 {
+			t.Errorf("Write timed out before deadline is set")
+		}
+	}()
+	wg.Wait()
+}
+
+func testConnFutureTimeout(t *testing.T, c1, c2 *ChanConn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	c1.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	go func() {
+		defer wg.Done()
+		_, err := c1.Read(make([]byte, 1024))
+		checkTimeoutError(t, err)
+	}()
+	go func() {
+		defer wg.Done()
+		checkTimeoutError(t, writeUntilError(c1))
+	}()
+	wg.Wait()
+}
+
+func testConnCloseTimeout(t *testing.T, c1, c2 *ChanConn) {
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	c1.SetDeadline(time.Now().Add(time.Hour))
+	go func() {
+		defer wg.Done()
+		time.Sleep(10 * time.Millisecond)
+		c1.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := c1.Read(make([]byte, 1024)); err == nil {
+			t.Errorf("Read succeeded after Close")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := writeUntilError(c1); err != ErrConnClosed {
+			t.Errorf("Expected ErrConnClosed, got %v", err)
+		}
+	}()
+	wg.Wait()
+}
+
+func testConnRacyClose(t *testing.T, c1, c2 *ChanConn) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			writeUntilError(c1)
+		}()
+		go func() {
+			defer wg.Done()
+			c1.Read(make([]byte, 1024))
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	c1.Close()
+	wg.Wait()
+}
+
+func testConnConcurrentMethods(t *testing.T, c1, c2 *ChanConn) {
+	go chunkedCopy(c2, c2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(7)
+		go func() {
+			defer wg.Done()
+			c1.Read(make([]byte, 1024))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.Write(make([]byte, 1024))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.SetDeadline(time.Now().Add(10 * time.Millisecond))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.SetReadDeadline(aLongTimeAgo)
+		}()
+		go func() {
+			defer wg.Done()
+			c1.SetWriteDeadline(aLongTimeAgo)
+		}()
+		go func() {
+			defer wg.Done()
+			c1.LocalAddr()
+		}()
+		go func() {
+			defer wg.Done()
+			c1.RemoteAddr()
+		}()
+	}
+	wg.Wait()
+
+	if err := c1.Close(); err != nil {
+		t.Errorf("Unexpected Close error: %v", err)
+	}
+}
+
+func TestSender(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	const senders = 8
+	const frames = 100
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(id byte) {
+			defer wg.Done()
+			w := client.Sender()
+			frame := bytes.Repeat([]byte{id}, 64+int(id))
+			for j := 0; j < frames; j++ {
+				if _, err := w.Write(frame); err != nil {
+					t.Errorf("Sender %d failed: %v", id, err)
+					return
+				}
+			}
+		}(byte(i))
+	}
+	go func() {
+		wg.Wait()
+		client.CloseWrite()
+	}()
+
+	counts := make([]int, senders)
+	buf := make([]byte, 1024)
+	for {
+		n, err := server.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Errorf("Read failed: %v", err)
+			return
+		}
+		id := buf[0]
+		if int(id) >= senders || n != 64+int(id) ||
+			!bytes.Equal(buf[:n], bytes.Repeat([]byte{id}, n)) {
+			t.Errorf("Corrupt frame %v", buf[:n])
+			return
+		}
+		counts[id]++
+	}
+	for i, c := range counts {
+		if c != frames {
+			t.Errorf("Sender %d: got %d frames, expected %d", i, c, frames)
+		}
+	}
+}
+
+func TestTryDial(t *testing.T) {
+	if _, err := TryDialChan("trydial.missing"); err != ErrConnRefused {
+		t.Errorf("Expected ErrConnRefused, got %v", err)
+		return
+	}
+
+	listener, err := ListenChan("trydial")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	start := time.Now()
+	if _, err := TryDialChan("trydial"); err != ErrWouldBlock {
+		t.Errorf("Expected ErrWouldBlock, got %v", err)
+		return
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("TryDialChan took %v", d)
+	}
+
+	// The abandoned request must not be accepted.
+	done := make(chan error)
+	go func() {
+		client, err := DialChan("trydial")
+		if err == nil {
+			client.Close()
+		}
+		done <- err
+	}()
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+	defer server.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Failed to dial: %v", err)
+	}
+
+	for listener.QueueLen() < listener.QueueCap() {
+		if _, err := TryDialChan("trydial"); err != ErrWouldBlock {
+			t.Errorf("Expected ErrWouldBlock, got %v", err)
+			return
+		}
+	}
+	if _, err := TryDialChan("trydial"); err != ErrListenQFull {
+		t.Errorf("Expected ErrListenQFull, got %v", err)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	listener, err := ListenChan("rebind")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+
+	done := make(chan error)
+	go func() {
+		client, err := DialChan("rebind")
+		if err == nil {
+			client.Write([]byte("hello"))
+			client.Close()
+		}
+		done <- err
+	}()
+	for listener.QueueLen() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	repl, err := listener.Rebind()
+	if err != nil {
+		t.Errorf("Failed to rebind: %v", err)
+		return
+	}
+	defer repl.Close()
+
+	if _, err := listener.AcceptChan(); err != ErrListenerClosed {
+		t.Errorf("Expected ErrListenerClosed, got %v", err)
+	}
+	// Closing the old listener must neither unregister the name nor
+	// reject the queue.
+	listener.Close()
+	if _, err := listener.Rebind(); err != ErrListenerClosed {
+		t.Errorf("Expected ErrListenerClosed, got %v", err)
+	}
+
+	server, err := repl.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+	defer server.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Failed to dial: %v", err)
+		return
+	}
+	b := make([]byte, 10)
+	if n, err := server.Read(b); err != nil || string(b[:n]) != "hello" {
+		t.Errorf("Unexpected read %q, %v", b[:n], err)
+	}
+}
+
+func TestRebindMaxConns(t *testing.T) {
+	lc := ListenConfig{MaxConns: 1}
+	listener, err := lc.Listen("rebind.maxconns")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	// The first client stays open until the end.
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		if client, err := DialChan("rebind.maxconns"); err == nil {
+			<-stop
+			client.Close()
+		}
+	}()
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+
+	repl, err := listener.Rebind()
+	if err != nil {
+		t.Errorf("Failed to rebind: %v", err)
+		return
+	}
+	defer repl.Close()
+
+	// The connection accepted before the rebind still counts.
+	if n := repl.ActiveConns(); n != 1 {
+		t.Errorf("Expected 1 active connection, got %d", n)
+	}
+	dialed := make(chan error, 1)
+	go func() {
+		client, err := DialChan("rebind.maxconns")
+		if err == nil {
+			client.Close()
+		}
+		dialed <- err
+	}()
+	repl.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := repl.AcceptChan(); err != ErrAcceptTimeout {
+		t.Errorf("Expected ErrAcceptTimeout, got %v", err)
+	}
+	if err := <-dialed; err != ErrConnRefused {
+		t.Errorf("Expected ErrConnRefused over the limit, got %v", err)
+	}
+
+	server.Close()
+	go func() {
+		if client, err := DialChan("rebind.maxconns"); err == nil {
+			client.Close()
+		}
+	}()
+	repl.SetDeadline(time.Now().Add(time.Second))
+	if server, err = repl.AcceptChan(); err != nil {
+		t.Errorf("Failed to accept after a close: %v", err)
+		return
+	}
+	server.Close()
+}
+
+func TestRebindTimeouts(t *testing.T) {
+	lc := ListenConfig{ReadTimeout: time.Minute, WriteTimeout: time.Hour}
+	listener, err := lc.Listen("rebind.timeouts")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	repl, err := listener.Rebind()
+	if err != nil {
+		t.Errorf("Failed to rebind: %v", err)
+		return
+	}
+	defer repl.Close()
+	if repl.ReadTimeout != time.Minute || repl.WriteTimeout != time.Hour {
+		t.Errorf("Timeouts not kept: %v, %v", repl.ReadTimeout,
+			repl.WriteTimeout)
+	}
+}
+
+func TestDialHook(t *testing.T) {
+	listener, err := ListenChan("dialhook")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	type dialed struct {
+		name string
+		d    time.Duration
+		err  error
+	}
+	var mtx sync.Mutex
+	var got []dialed
+	SetDialHook(func(name string, d time.Duration, err error) {
+		mtx.Lock()
+		got = append(got, dialed{name, d, err})
+		mtx.Unlock()
+	})
+	defer SetDialHook(nil)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		if server, err := listener.AcceptChan(); err == nil {
+			server.Close()
+		}
+	}()
+	client, err := DialChan("dialhook")
+	if err != nil {
+		t.Errorf("Failed to dial: %v", err)
+		return
+	}
+	client.Close()
+	DialChan("dialhook.none")
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(got) != 2 {
+		t.Errorf("Expected 2 dials, got %v", got)
+		return
+	}
+	if got[0].name != "dialhook" || got[0].err != nil ||
+		got[0].d < 10*time.Millisecond {
+		t.Errorf("Unexpected dial %+v", got[0])
+	}
+	if got[1].name != "dialhook.none" || got[1].err != ErrConnRefused ||
+		got[1].d < 0 {
+		t.Errorf("Unexpected dial %+v", got[1])
+	}
+}
+
+func TestDefaultDialTimeout(t *testing.T) {
+	SetDefaultDialTimeout(50 * time.Millisecond)
+	defer SetDefaultDialTimeout(10 * time.Second)
+
+	listener, err := ListenChan("dialtimeout")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	start := time.Now()
+	_, err = DialChan("dialtimeout")
+	elapsed := time.Since(start)
+	if err != ErrConnTimeout {
+		t.Errorf("Expected ErrConnTimeout, got %v", err)
+	}
+	if elapsed < 50*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Dial took %v, expected about 50ms", elapsed)
+	}
+}
+
+func TestEOFAfterData(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		client, server := PipeChan()
+		go func() {
+			for j := 0; j < 100; j++ {
+				client.Write([]byte{byte(j)})
+			}
+			client.CloseWrite()
+		}()
+
+		got := 0
+		b := make([]byte, 1)
+		for {
+			n, err := server.Read(b)
+			if err == io.EOF {
+				break
+			}
+			if err != nil || n != 1 || b[0] != byte(got) {
+				t.Errorf("Unexpected read %v, %d, %v", b, n, err)
+				return
+			}
+			got++
+		}
+		if got != 100 {
+			t.Errorf("Got %d messages before EOF, expected 100", got)
+			return
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestEOFRepeated(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	client.Write([]byte("last"))
+	client.CloseWrite()
+	b := make([]byte, 10)
+	if n, err := server.Read(b); n != 4 || err != nil {
+		t.Errorf("Unexpected read %d, %v", n, err)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			if n, err := server.Read(b); n != 0 || err != io.EOF {
+				t.Errorf("Read %d: expected EOF, got %d, %v", i, n, err)
+			}
+		}
+		// Even once the deadline has passed, EOF sticks.
+		server.SetReadDeadline(time.Now().Add(-time.Second))
+		if n, err := server.Read(b); n != 0 || err != io.EOF {
+			t.Errorf("Expected EOF after deadline, got %d, %v", n, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Read blocked after EOF")
+	}
+}
+
+func TestAcceptFilter(t *testing.T) {
+	listener, err := ListenChan("acceptfilter")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	errBadToken := errors.New("bad token")
+	accepted := 0
+	listener.AcceptFilter = func(meta []byte) error {
+		if string(meta) != "good" {
+			return errBadToken
+		}
+		return nil
+	}
+	listener.OnAccept = func(*ChanConn) { accepted++ }
+
+	done := make(chan error)
+	go func() {
+		_, err := DialChanMeta("acceptfilter", []byte("bad"))
+		done <- err
+	}()
+
+	listener.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := listener.AcceptChan(); err != ErrAcceptTimeout {
+		t.Errorf("Expected ErrAcceptTimeout, got %v", err)
+	}
+	if err := <-done; err != errBadToken {
+		t.Errorf("Expected the filter's error, got %v", err)
+	}
+	if accepted != 0 {
+		t.Errorf("A rejected connection was created")
+	}
+
+	go func() {
+		client, err := DialChanMeta("acceptfilter", []byte("good"))
+		if err == nil {
+			client.Close()
+		}
+		done <- err
+	}()
+	listener.SetDeadline(time.Time{})
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+	server.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Failed to dial: %v", err)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	client.Write([]byte("hello"))
+	client.Write([]byte("world"))
+	client.CloseWrite()
+
+	b := make([]byte, 2)
+	if n, err := server.Read(b); n != 2 || err != nil {
+		t.Errorf("Unexpected read %d, %v", n, err)
+		return
+	}
+	for _, want := range []string{"llo", "world"} {
+		msg, err := server.ReadMessage()
+		if err != nil || string(msg) != want {
+			t.Errorf("Expected %q, got %q, %v", want, msg, err)
+			return
+		}
+	}
+	if _, err := server.ReadMessage(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func benchmarkReadMessages(b *testing.B, read func(*ChanConn) error) {
+	client, server := PipeChan()
+	defer server.Close()
+	msg := make([]byte, 4096)
+
+	// Send the same buffer each time, bypassing the copy in Write, so
+	// that only the cost of reading is measured.
+	go func() {
+		for i := 0; i < b.N; i++ {
+			client.send(msg, time.Time{})
+		}
+		client.Close()
+	}()
+
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := read(server); err != nil {
+			b.Fatalf("Read failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkReadCopy(b *testing.B) {
+	buf := make([]byte, 4096)
+	benchmarkReadMessages(b, func(c *ChanConn) error {
+		_, err := c.Read(buf)
+		return err
+	})
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	benchmarkReadMessages(b, func(c *ChanConn) error {
+		_, err := c.ReadMessage()
+		return err
+	})
+}
+
+func TestAddAlias(t *testing.T) {
+	listener, err := ListenChan("v1")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	if err := listener.AddAlias("latest"); err != nil {
+		t.Errorf("Failed to add alias: %v", err)
+		return
+	}
+	if err := listener.AddAlias("v1"); err != ErrAddrInUse {
+		t.Errorf("Expected ErrAddrInUse, got %v", err)
+	}
+
+	for _, name := range []string{"v1", "latest"} {
+		done := make(chan error)
+		go func() {
+			client, err := DialChan(name)
+			if err == nil {
+				client.Close()
+			}
+			done <- err
+		}()
+		server, err := listener.AcceptChan()
+		if err != nil {
+			t.Errorf("Failed to accept %s: %v", name, err)
+			return
+		}
+		server.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Failed to dial %s: %v", name, err)
+		}
+	}
+
+	listener.Close()
+	if _, err := DialChan("latest"); err != ErrConnRefused {
+		t.Errorf("Expected ErrConnRefused, got %v", err)
+	}
+	l2, err := ListenChan("latest")
+	if err != nil {
+		t.Errorf("Alias not released: %v", err)
+		return
+	}
+	l2.Close()
+}
+
+func TestPastWriteDeadline(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	// There is always room, so only the deadline can stop the Write.
+	client.SetWriteDeadline(time.Now().Add(-time.Second))
+	for _, delay := range []bool{false, true} {
+		client.SetNoDelay(!delay)
+		for i := 0; i < 1000; i++ {
+			if n, err := client.Write([]byte("x")); n != 0 || err != ErrWrTimeout {
+				t.Errorf("Expected ErrWrTimeout (delay %v), got %d, %v",
+					delay, n, err)
+				return
+			}
+		}
+	}
+	if n := client.Buffered(); n != 0 {
+		t.Errorf("%d messages sent despite the deadline", n)
+	}
+}
+
+func TestWriteTimeoutPeerState(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+
+	// Nobody reads, so the buffer fills and the write times out.
+	client.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	var err error
+	for err == nil {
+		_, err = client.Write([]byte("stalled"))
+	}
+	if err != ErrWrTimeout {
+		t.Errorf("Expected ErrWrTimeout for a stalled peer, got %v", err)
+	}
+
+	// Once the peer has gone, the same write reports that instead.
+	server.Close()
+	if _, err := client.Write([]byte("gone")); err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed for a closed peer, got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	client, server := mkPair(t, "stats")
+	defer server.Close()
+
+	client.Write([]byte("hello"))
+	client.Write([]byte("world!"))
+	b := make([]byte, 100)
+	server.Read(b)
+	server.Read(b)
+
+	cs := client.Stats()
+	if cs.BytesWritten != 11 || cs.Messages != 2 || cs.BytesRead != 0 {
+		t.Errorf("Unexpected client stats %+v", cs)
+	}
+	ss := server.Stats()
+	if ss.BytesRead != 11 || ss.Messages != 2 || ss.BytesWritten != 0 {
+		t.Errorf("Unexpected server stats %+v", ss)
+	}
+	if cs.OpenedAt.IsZero() || !cs.ClosedAt.IsZero() {
+		t.Errorf("Unexpected timestamps %+v", cs)
+	}
+
+	client.Close()
+	cs = client.Stats()
+	if cs.ClosedAt.Before(cs.OpenedAt) || cs.ClosedAt.IsZero() {
+		t.Errorf("ClosedAt not set after Close: %+v", cs)
+	}
+}
+
+func TestDialClosingListener(t *testing.T) {
+	listener, err := ListenChan("closinglistener")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	// Closed, but not yet removed from the registry.
+	listener.mtx.Lock()
+	listener.closed = true
+	listener.mtx.Unlock()
+	if _, err := DialChan("closinglistener"); err != ErrConnRefused {
+		t.Errorf("Expected ErrConnRefused, got %v", err)
+	}
+	listener.mtx.Lock()
+	listener.closed = false
+	listener.mtx.Unlock()
+
+	// A listener that was never set up has nothing to send on.
+	n := NewNetwork()
+	n.lst = map[string]*ChanListener{"nil": {name: "nil"}}
+	d := &Dialer{WaitForBacklog: true, Timeout: time.Second, Network: n}
+	if _, err := d.DialContext(context.Background(), "nil"); err != ErrConnRefused {
+		t.Errorf("Expected ErrConnRefused, got %v", err)
+	}
+}
+
+func TestDialCloseRace(t *testing.T) {
+	SetDefaultDialTimeout(5 * time.Second)
+	defer SetDefaultDialTimeout(10 * time.Second)
+
+	for i := 0; i < 200; i++ {
+		listener, err := ListenChan("dialcloserace")
+		if err != nil {
+			t.Errorf("Failed to listen: %v", err)
+			return
+		}
+		done := make(chan error)
+		go func() {
+			_, err := DialChan("dialcloserace")
+			done <- err
+		}()
+		if i%2 == 0 {
+			runtime.Gosched()
+		}
+		listener.Close()
+		if err := <-done; err != ErrConnRefused && err != ErrConnClosed {
+			t.Errorf("Expected the dial to be refused, got %v", err)
+			return
+		}
+	}
+}
+
+func TestReadKeepAlive(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	// The client sends nothing for a while, but is waiting in Read, so
+	// it answers the probes.
+	go client.Read(make([]byte, 10))
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		client.Write([]byte("alive"))
+	}()
+	server.SetReadKeepAlive(10*time.Millisecond, 50*time.Millisecond)
+	b := make([]byte, 10)
+	if n, err := server.Read(b); err != nil || string(b[:n]) != "alive" {
+		t.Errorf("Unexpected read %q, %v", b[:n], err)
+	}
+}
+
+func TestReadKeepAliveDead(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	// Nothing is serving the client, as if its goroutine had died.
+	server.SetReadKeepAlive(10*time.Millisecond, 20*time.Millisecond)
+	start := time.Now()
+	if _, err := server.Read(make([]byte, 10)); err != ErrKeepAlive {
+		t.Errorf("Expected ErrKeepAlive, got %v", err)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("Gave up after only %v", d)
+	}
+
+	// The data is untouched by the probes.
+	client.Write([]byte("late"))
+	server.SetReadKeepAlive(0, 0)
+	b := make([]byte, 10)
+	if n, err := server.Read(b); err != nil || string(b[:n]) != "late" {
+		t.Errorf("Unexpected read %q, %v", b[:n], err)
+	}
+}
+
+func TestReadIdleTimeout(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	server.SetReadIdleTimeout(100 * time.Millisecond)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		client.Write([]byte("late"))
+	}()
+	b := make([]byte, 10)
+	if _, err := server.Read(b); err != ErrIdleTimeout {
+		t.Errorf("Expected ErrIdleTimeout, got %v", err)
+		return
+	}
+	server.SetReadIdleTimeout(0)
+	if n, err := server.Read(b); n != 4 || err != nil {
+		t.Errorf("Data lost after idle timeout: %d, %v", n, err)
+		return
+	}
+
+	// A steady trickle, each part well within the timeout, although
+	// all of it takes longer.
+	server.SetReadIdleTimeout(100 * time.Millisecond)
+	go func() {
+		for i := 0; i < 20; i++ {
+			time.Sleep(10 * time.Millisecond)
+			client.Write([]byte{byte(i)})
+		}
+	}()
+	if _, err := io.ReadFull(server, make([]byte, 20)); err != nil {
+		t.Errorf("Trickle timed out: %v", err)
+	}
+}
+
+func TestPerCallDeadline(t *testing.T) {
+	client, server := PipeChanSync()
+	defer client.Close()
+	defer server.Close()
+
+	b := make([]byte, 10)
+	start := time.Now()
+	if _, err := server.ReadDeadline(b, time.Now().Add(20*time.Millisecond)); err != ErrRdTimeout {
+		t.Errorf("Expected ErrRdTimeout, got %v", err)
+		return
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Timed out after only %v", d)
+	}
+	// Nobody is reading, so an unbuffered write must wait.
+	if _, err := client.WriteDeadline([]byte("x"), time.Now().Add(20*time.Millisecond)); err != ErrWrTimeout {
+		t.Errorf("Expected ErrWrTimeout, got %v", err)
+		return
+	}
+
+	// The stored deadlines are untouched, so these wait as long as needed.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.WriteDeadline([]byte("late"), time.Time{})
+	}()
+	if n, err := server.ReadDeadline(b, time.Time{}); n != 4 || err != nil {
+		t.Errorf("Unexpected read %d, %v", n, err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		server.Read(b)
+	}()
+	if n, err := client.Write([]byte("ok")); n != 2 || err != nil {
+		t.Errorf("Unexpected write %d, %v", n, err)
+	}
+}
+
+func TestClearReadDeadline(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	done := make(chan error)
+	go func() {
+		b := make([]byte, 10)
+		n, err := server.Read(b)
+		if err == nil && string(b[:n]) != "late" {
+			err = fmt.Errorf("unexpected data %q", b[:n])
+		}
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	server.SetReadDeadline(time.Time{})
+
+	select {
+	case err := <-done:
+		t.Errorf("Read returned early: %v", err)
+		return
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	client.Write([]byte("late"))
+	if err := <-done; err != nil {
+		t.Errorf("Read failed: %v", err)
+	}
+}
+
+func TestParseChanAddr(t *testing.T) {
+	a, err := ParseChanAddr("svc:7")
+	if err != nil {
+		t.Errorf("Failed to parse: %v", err)
+		return
+	}
+	if disc, ok := a.Disc(); a.Name() != "svc" || disc != 7 || !ok {
+		t.Errorf("Unexpected address %q %d %v", a.Name(), disc, ok)
+	}
+	if a.String() != "svc:7" || a.Network() != "chan" {
+		t.Errorf("Unexpected address %s/%s", a.Network(), a)
+	}
+	if host, port, err := net.SplitHostPort(a.String()); host != "svc" ||
+		port != "7" || err != nil {
+		t.Errorf("SplitHostPort gave %q %q %v", host, port, err)
+	}
+
+	a, err = ParseChanAddr("plain")
+	if _, ok := a.Disc(); err != nil || ok || a.String() != "plain" {
+		t.Errorf("Unexpected address %v, %v", a, err)
+	}
+	for _, s := range []string{"", ":7", "svc:99999999999999999999"} {
+		if _, err := ParseChanAddr(s); err != ErrInvalidAddr {
+			t.Errorf("Expected ErrInvalidAddr for %q, got %v", s, err)
+		}
+	}
+	// Names that merely contain a colon, as ListenChan allows.
+	for _, s := range []string{"host:http", "a/b:c", "svc:", "svc:x",
+		"svc:-1"} {
+		a, err := ParseChanAddr(s)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", s, err)
+			continue
+		}
+		if _, ok := a.Disc(); ok || a.Name() != s || a.String() != s {
+			t.Errorf("Unexpected address %v for %q", a, s)
+		}
+	}
+
+	client, server := mkPair(t, "parseaddr")
+	defer client.Close()
+	defer server.Close()
+	a, err = ParseChanAddr(client.LocalAddr().String())
+	if err != nil || a.Name() != "parseaddr" {
+		t.Errorf("Client address %v did not parse: %v", client.LocalAddr(), err)
+	}
+}
+
+func TestChanAddrScheme(t *testing.T) {
+	a, err := ParseChanAddr("svc://billing/v2")
+	if err != nil {
+		t.Errorf("Failed to parse: %v", err)
+		return
+	}
+	if a.Scheme() != "svc" || a.Service() != "billing" || a.Path() != "/v2" {
+		t.Errorf("Unexpected parts %q %q %q", a.Scheme(), a.Service(), a.Path())
+	}
+	if _, ok := a.Disc(); ok || a.String() != "svc://billing/v2" ||
+		a.Network() != "chan" {
+		t.Errorf("Unexpected address %s/%s", a.Network(), a)
+	}
+	a, err = ParseChanAddr("svc://billing:3")
+	if disc, _ := a.Disc(); err != nil || disc != 3 || a.Service() != "billing" {
+		t.Errorf("Unexpected address %v, %v", a, err)
+	}
+	a, _ = ParseChanAddr("plain")
+	if a.Scheme() != "" || a.Service() != "" || a.Path() != "" {
+		t.Errorf("Parts for a plain name %q %q %q", a.Scheme(), a.Service(),
+			a.Path())
+	}
+
+	// The whole name is still the key.
+	client, server := mkPair(t, "svc://billing/v2")
+	defer client.Close()
+	defer server.Close()
+	if addr := server.LocalAddr().(*ChanAddr); addr.Service() != "billing" {
+		t.Errorf("Unexpected local address %v", addr)
+	}
+	if _, err := DialChan("svc://billing"); err != ErrConnRefused {
+		t.Errorf("Expected ErrConnRefused, got %v", err)
+	}
+}
+
+func TestWriteWithPressure(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	last := 0.0
+	for i := 0; i < 10; i++ {
+		_, p, err := client.WriteWithPressure([]byte("data"))
+		if err != nil {
+			t.Errorf("Write failed: %v", err)
+			return
+		}
+		if p <= last {
+			t.Errorf("Pressure did not climb: %v after %v", p, last)
+		}
+		last = p
+	}
+	if last != 1.0 {
+		t.Errorf("Expected a full buffer, got pressure %v", last)
+	}
+
+	b := make([]byte, 10)
+	for i := 0; i < 5; i++ {
+		server.Read(b)
+	}
+	if _, p, _ := client.WriteWithPressure([]byte("data")); p != 0.6 {
+		t.Errorf("Expected pressure 0.6, got %v", p)
+	}
+}
+
+func TestNewChanError(t *testing.T) {
+	var err error = NewChanError("Custom timeout.", true, false)
+	ne, ok := err.(net.Error)
+	if !ok {
+		t.Errorf("ChanError is not a net.Error")
+		return
+	}
+	if !ne.Timeout() || ne.Temporary() || ne.Error() != "Custom timeout." {
+		t.Errorf("Unexpected error %v: %v %v", ne, ne.Timeout(),
+			ne.Temporary())
+	}
+	if NewChanError("Custom timeout.", true, false).Kind() != KindTimeout {
+		t.Errorf("Expected KindTimeout")
+	}
+
+	err = NewChanError("Custom.", false, true)
+	if ne := err.(net.Error); ne.Timeout() || !ne.Temporary() {
+		t.Errorf("Unexpected flags on %v", ne)
+	}
+	if !errors.Is(NewChanError("Write timeout.", true, true), ErrWrTimeout) {
+		t.Errorf("Expected an equivalent error to match")
+	}
+}
+
+func TestSelfPeer(t *testing.T) {
+	conn, _ := PipeChan()
+	conn.peer = conn
+
+	b := make([]byte, 10)
+	if _, err := conn.Read(b); err != ErrSelfPeer {
+		t.Errorf("Expected ErrSelfPeer from Read, got %v", err)
+	}
+	if _, err := conn.Write(b); err != ErrSelfPeer {
+		t.Errorf("Expected ErrSelfPeer from Write, got %v", err)
+	}
+
+	c1, c2 := PipeChan()
+	defer c1.Close()
+	defer c2.Close()
+	if err := c1.Mirror(c1); err != ErrSelfPeer {
+		t.Errorf("Expected ErrSelfPeer from Mirror, got %v", err)
+	}
+	if err := c1.Mirror(c2); err != ErrSelfPeer {
+		t.Errorf("Expected ErrSelfPeer from Mirror, got %v", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	listener, err := ListenChan("serve")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+
+	var handled sync.WaitGroup
+	done := make(chan error)
+	go func() {
+		done <- listener.Serve(func(conn *ChanConn) {
+			defer handled.Done()
+			io.Copy(conn, conn)
+			conn.Close()
+		})
+	}()
+
+	const clients = 5
+	handled.Add(clients)
+	for i := 0; i < clients; i++ {
+		client, err := DialChan("serve")
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+			return
+		}
+		client.Write([]byte("echo"))
+		client.CloseWrite()
+		if got, err := io.ReadAll(client); err != nil || string(got) != "echo" {
+			t.Errorf("Unexpected reply %q, %v", got, err)
+		}
+		client.Close()
+	}
+	handled.Wait()
+
+	listener.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestDialWaitForBacklog(t *testing.T) {
+	listener, err := ListenChan("waitbacklog")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	// Fill the backlog with requests that will never be accepted.
+	for listener.QueueLen() < listener.QueueCap() {
+		TryDialChan("waitbacklog")
+	}
+	if _, err := DialChanContext(context.Background(), "waitbacklog"); err != ErrListenQFull {
+		t.Errorf("Expected ErrListenQFull, got %v", err)
+	}
+
+	d := &Dialer{Timeout: 50 * time.Millisecond, WaitForBacklog: true}
+	if _, err := d.DialContext(context.Background(), "waitbacklog"); err != ErrListenQFull {
+		t.Errorf("Expected ErrListenQFull after waiting, got %v", err)
+	}
+
+	d.Timeout = 5 * time.Second
+	done := make(chan error)
+	go func() {
+		client, err := d.DialContext(context.Background(), "waitbacklog")
+		if err == nil {
+			client.Close()
+		}
+		done <- err
+	}()
+	// Accepting skips the abandoned requests, making room for the dial.
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+	server.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Waiting dial failed: %v", err)
+	}
+}
+
+func TestDialQFullRetries(t *testing.T) {
+	listener, err := (&ListenConfig{Backlog: 4}).Listen("qfullretries")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	for listener.QueueLen() < listener.QueueCap() {
+		TryDialChan("qfullretries")
+	}
+	before := listener.Stats().QueueFull
+	d := &Dialer{MaxQFullRetries: 2, RetryDelay: time.Millisecond}
+	if _, err := d.DialContext(context.Background(), "qfullretries"); err != ErrListenQFull {
+		t.Errorf("Expected ErrListenQFull, got %v", err)
+		return
+	}
+	if n := listener.Stats().QueueFull - before; n != 3 {
+		t.Errorf("Expected 3 attempts, got %d", n)
+	}
+
+	d = &Dialer{MaxQFullRetries: 1000, RetryDelay: time.Millisecond}
+	done := make(chan error)
+	go func() {
+		client, err := d.DialContext(context.Background(), "qfullretries")
+		if err == nil {
+			client.Close()
+		}
+		done <- err
+	}()
+	// Accepting drains the abandoned requests, so a retry gets in.
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+	server.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Retrying dial failed: %v", err)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	listener, err := ListenChan("dialcontext")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := DialChanContext(ctx, "dialcontext"); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := DialChanContext(ctx, "dialcontext"); err != ErrConnTimeout {
+		t.Errorf("Expected ErrConnTimeout, got %v", err)
+	}
+}
+
+func TestDialChanWait(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialed := make(chan error, 1)
+	go func() {
+		client, err := DialChanWait(ctx, "dialwait")
+		if err == nil {
+			client.Close()
+		}
+		dialed <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	listener, err := ListenChan("dialwait")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+	server.Close()
+	if err := <-dialed; err != nil {
+		t.Errorf("DialChanWait failed: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := DialChanWait(ctx, "dialwait.none"); err != ErrConnTimeout {
+		t.Errorf("Expected ErrConnTimeout, got %v", err)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	n := NewNetwork()
+	listener, err := n.Listen("network")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	// The name is not visible on the default Network, nor taken there.
+	if _, err := DialChan("network"); err != ErrConnRefused {
+		t.Errorf("Expected ErrConnRefused, got %v", err)
+	}
+	other, err := ListenChan("network")
+	if err != nil {
+		t.Errorf("Name taken on the default Network: %v", err)
+		return
+	}
+	other.Close()
+	if names := n.ListListeners(); len(names) != 1 || names[0] != "network" {
+		t.Errorf("Unexpected listeners %v", names)
+	}
+
+	go func() {
+		if server, err := listener.AcceptChan(); err == nil {
+			server.Close()
+		}
+	}()
+	client, err := n.Dial("network")
+	if err != nil {
+		t.Errorf("Failed to dial: %v", err)
+		return
+	}
+	client.Close()
+}
+
+func TestDisableDefaultRegistry(t *testing.T) {
+	n := NewNetwork()
+	DisableDefaultRegistry()
+	defer atomic.StoreInt32(&defaultOff, 0)
+
+	if _, err := ListenChan("disabled"); err != ErrNoRegistry {
+		t.Errorf("Expected ErrNoRegistry from ListenChan, got %v", err)
+	}
+	if _, err := DialChan("disabled"); err != ErrNoRegistry {
+		t.Errorf("Expected ErrNoRegistry from DialChan, got %v", err)
+	}
+	if _, err := DialChanContext(context.Background(), "disabled"); err != ErrNoRegistry {
+		t.Errorf("Expected ErrNoRegistry from DialChanContext, got %v", err)
+	}
+	if _, err := TryDialChan("disabled"); err != ErrNoRegistry {
+		t.Errorf("Expected ErrNoRegistry from TryDialChan, got %v", err)
+	}
+	if names := ListListeners(); names != nil {
+		t.Errorf("Listed %v", names)
+	}
+
+	listener, err := n.Listen("disabled")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+	go func() {
+		if server, err := listener.AcceptChan(); err == nil {
+			server.Close()
+		}
+	}()
+	client, err := n.DialContext(context.Background(), "disabled")
+	if err != nil {
+		t.Errorf("Failed to dial: %v", err)
+		return
+	}
+	client.Close()
+}
+
+func TestListListeners(t *testing.T) {
+	ResetRegistry()
+	want := []string{"list.a", "list.b", "list.c"}
+	for _, name := range want {
+		listener, err := ListenChan(name)
+		if err != nil {
+			t.Errorf("Failed to listen: %v", err)
+			return
+		}
+		defer listener.Close()
+	}
+	got := ListListeners()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestReadEmpty(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	// Nothing has been sent, so these would block if they waited.
+	for _, b := range [][]byte{nil, make([]byte, 0), make([]byte, 0, 10)} {
+		if n, err := server.Read(b); n != 0 || err != nil {
+			t.Errorf("Unexpected read %d, %v", n, err)
+		}
+	}
+
+	client.Write([]byte("data"))
+	client.CloseWrite()
+	if n, err := server.Read(nil); n != 0 || err != nil {
+		t.Errorf("Unexpected read %d, %v", n, err)
+	}
+	b := make([]byte, 10)
+	if n, err := server.Read(b); n != 4 || err != nil {
+		t.Errorf("Data lost by empty read: %d, %v", n, err)
+	}
+}
+
+func TestNoDelay(t *testing.T) {
+	client, server := PipeChan()
+	defer server.Close()
+
+	if err := client.SetNoDelay(false); err != nil {
+		t.Errorf("SetNoDelay failed: %v", err)
+		return
+	}
+	want := make([]byte, 20000)
+	rand.Read(want)
+
+	got := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(server)
+		got <- b
+	}()
+	for b := want; len(b) > 0; {
+		n := 1 + rand.Intn(32)
+		if n > len(b) {
+			n = len(b)
+		}
+		if i, err := client.Write(b[:n]); i != n || err != nil {
+			t.Errorf("Write failed: %d, %v", i, err)
+			return
+		}
+		b = b[n:]
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	if !bytes.Equal(<-got, want) {
+		t.Errorf("Coalesced data differs")
+	}
+	if m := client.Stats().Messages; m > 100 {
+		t.Errorf("Writes were not coalesced, %d messages", m)
+	}
+}
+
+func TestNoDelayTimer(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	client.SetNoDelay(false)
+	client.Write([]byte("hello, "))
+	client.WriteString("world")
+
+	// The batch is sent shortly, without a Flush.
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 20)
+	if n, err := server.Read(b); err != nil || string(b[:n]) != "hello, world" {
+		t.Errorf("Unexpected read %q, %v", b[:n], err)
+	}
+}
+
+func TestNoDelayCloseFull(t *testing.T) {
+	client, server := PipeChan()
+	defer server.Close()
+
+	// Fill the buffer to the peer, which never reads.
+	client.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	for {
+		if _, err := client.Write([]byte("x")); err != nil {
+			break
+		}
+	}
+	client.SetWriteDeadline(time.Time{})
+	client.SetNoDelay(false)
+	client.Write([]byte("stuck"))
+	time.Sleep(5 * coalesceDelay)
+
+	// Detach does not wait for room, and Close only until the write
+	// deadline, reporting that the batch was dropped.
+	client.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	done := make(chan error)
+	go func() {
+		client.Detach()
+		client.Attach()
+		done <- client.Close()
+	}()
+	select {
+	case err := <-done:
+		if err != ErrWrTimeout {
+			t.Errorf("Expected ErrWrTimeout from Close, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Detach or Close blocked on a full buffer")
+	}
+}
+
+func TestNoDelayCloseFlushes(t *testing.T) {
+	client, server := PipeChanSync()
+	defer server.Close()
+
+	client.SetNoDelay(false)
+	if n, err := client.Write([]byte("hello")); n != 5 || err != nil {
+		t.Errorf("Unexpected write %d, %v", n, err)
+	}
+	got := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(server)
+		got <- b
+	}()
+	if err := client.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if b := <-got; string(b) != "hello" {
+		t.Errorf("Peer read %q", b)
+	}
+}
+
+func benchmarkWriteTiny(b *testing.B, noDelay bool) {
+	client, server := PipeChan()
+	defer server.Close()
+	client.SetNoDelay(noDelay)
+	go io.Copy(io.Discard, server)
+
+	msg := make([]byte, 16)
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.Write(msg)
+	}
+	client.Flush()
+	client.Close()
+}
+
+func BenchmarkWriteTiny(b *testing.B) {
+	benchmarkWriteTiny(b, true)
+}
+
+func BenchmarkWriteTinyCoalesced(b *testing.B) {
+	benchmarkWriteTiny(b, false)
+}
+
+// fired reports whether ch is closed, waiting briefly for it.
+func fired(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(50 * time.Millisecond):
+		return false
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+
+	if _, ok := client.CloseReason(); ok {
+		t.Errorf("Reason given before close")
+	}
+	server.Write([]byte("bye"))
+	server.CloseWithReason("shutting down")
+
+	b, err := io.ReadAll(client)
+	if err != nil || string(b) != "bye" {
+		t.Errorf("Unexpected read %q, %v", b, err)
+	}
+	if reason, ok := client.CloseReason(); !ok || reason != "shutting down" {
+		t.Errorf("Unexpected reason %q, %v", reason, ok)
+	}
+
+	// A plain close gives no reason.
+	c1, c2 := PipeChan()
+	c1.Close()
+	defer c2.Close()
+	if _, ok := c2.CloseReason(); ok {
+		t.Errorf("Reason given for a plain close")
+	}
+}
+
+func TestDoneLocalClose(t *testing.T) {
+	client, server := PipeChan()
+	defer server.Close()
+
+	done := client.Done()
+	client.CloseWrite()
+	if fired(done) {
+		t.Errorf("Done fired on half-close")
+		return
+	}
+	client.CloseRead()
+	if !fired(done) {
+		t.Errorf("Done did not fire once both halves were closed")
+	}
+
+	c1, c2 := PipeChan()
+	defer c2.Close()
+	c1.Close()
+	if !fired(c1.Done()) {
+		t.Errorf("Done did not fire after local Close")
+	}
+	if !fired(c2.Done()) {
+		t.Errorf("Done did not fire after peer Close")
+	}
+}
+
+func TestReadNotGreedy(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	// Also with a read buffer, which coalesces, but never waits.
+	for _, rdbuf := range []int{0, 1024} {
+		server.SetReadBuffer(rdbuf)
+		client.Write([]byte("abcd"))
+
+		done := make(chan bool)
+		go func() {
+			b := make([]byte, 64)
+			n, err := server.Read(b)
+			if n != 4 || err != nil {
+				t.Errorf("Unexpected read %d, %v", n, err)
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("Read waited for more data")
+			return
+		}
+	}
+}
+
+func TestAcceptClosedQueue(t *testing.T) {
+	listener, err := ListenChan("acceptclosedq")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := listener.AcceptChan()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(listener.connect)
+	select {
+	case err := <-done:
+		if err != ErrListenerClosed {
+			t.Errorf("Expected ErrListenerClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("AcceptChan did not return")
+	}
+	if err := listener.Reject(); err != nil {
+		t.Errorf("Reject failed: %v", err)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	client.SetMaxMessageSize(8, false)
+	if n, err := client.Write(make([]byte, 9)); n != 0 || err != ErrMsgTooLong {
+		t.Errorf("Expected ErrMsgTooLong, got %d, %v", n, err)
+	}
+	if n, err := client.Write(make([]byte, 8)); n != 8 || err != nil {
+		t.Errorf("Unexpected write %d, %v", n, err)
+	}
+	b := make([]byte, 20)
+	if n, err := server.Read(b); n != 8 || err != nil {
+		t.Errorf("Unexpected read %d, %v", n, err)
+	}
+
+	client.SetMaxMessageSize(8, true)
+	if err := client.WriteMsg(make([]byte, 9)); err != ErrMsgTooLong {
+		t.Errorf("Expected ErrMsgTooLong from WriteMsg, got %v", err)
+	}
+	want := []byte("a longer message, in several parts")
+	if n, err := client.Write(want); n != len(want) || err != nil {
+		t.Errorf("Unexpected write %d, %v", n, err)
+	}
+	client.CloseWrite()
+	server.SetMessageMode(true)
+	var got []byte
+	for {
+		n, err := server.Read(b)
+		if err == io.EOF {
+			break
+		}
+		if n > 8 || err != nil {
+			t.Errorf("Unexpected read %d, %v", n, err)
+			return
+		}
+		got = append(got, b[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Reassembled %q, expected %q", got, want)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	client.SetMaxMessageSize(1000, true)
+	sizes := []int{0, 1, 100, 5000, 100000}
+	go func() {
+		for _, size := range sizes {
+			if err := client.WriteFrame(bytes.Repeat([]byte{byte(size)}, size)); err != nil {
+				t.Errorf("Unexpected error writing frame of %d: %v", size, err)
+				return
+			}
+		}
+		client.Write([]byte{0, 0, 1})
+		client.CloseWrite()
+	}()
+	for _, size := range sizes {
+		b, err := server.ReadFrame()
+		if err != nil {
+			t.Errorf("Unexpected error reading frame of %d: %v", size, err)
+			return
+		}
+		if !bytes.Equal(b, bytes.Repeat([]byte{byte(size)}, size)) {
+			t.Errorf("Frame of %d read back as %d bytes", size, len(b))
+		}
+	}
+	if _, err := server.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF for a partial frame, got %v", err)
+	}
+
+	client, server = PipeChan()
+	defer client.Close()
+	defer server.Close()
+	if err := client.WriteFrame(make([]byte, maxFrame+1)); err != ErrMsgTooLong {
+		t.Errorf("Expected ErrMsgTooLong writing a huge frame, got %v", err)
+	}
+	client.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := server.ReadFrame(); err != ErrMsgTooLong {
+		t.Errorf("Expected ErrMsgTooLong reading a huge frame, got %v", err)
+	}
+	client.CloseWrite()
+	if _, err := server.ReadFrame(); err != io.EOF {
+		t.Errorf("Expected EOF between frames, got %v", err)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	server.SetReadLimit(100)
+	for i := 0; i < 3; i++ {
+		if _, err := client.Write(make([]byte, 50)); err != nil {
+			t.Errorf("Failed to write: %v", err)
+			return
+		}
+	}
+	b := make([]byte, 100)
+	if n, err := io.ReadFull(server, b); n != 100 || err != nil {
+		t.Errorf("Unexpected read %d, %v", n, err)
+		return
+	}
+	if n, err := server.Read(b); n != 0 || err != ErrReadLimit {
+		t.Errorf("Expected ErrReadLimit, got %d, %v", n, err)
+	}
+
+	// Reading exactly up to the limit still ends in EOF.
+	client2, server2 := PipeChan()
+	defer server2.Close()
+	server2.SetReadLimit(100)
+	client2.Write(make([]byte, 100))
+	client2.Close()
+	if n, err := io.ReadFull(server2, b); n != 100 || err != nil {
+		t.Errorf("Unexpected read %d, %v", n, err)
+		return
+	}
+	if n, err := server2.Read(b); n != 0 || err != io.EOF {
+		t.Errorf("Expected EOF, got %d, %v", n, err)
+	}
+
+	// ReadMessage is limited too, cutting short the message that
+	// crosses the limit.
+	client3, server3 := PipeChan()
+	defer client3.Close()
+	defer server3.Close()
+	server3.SetReadLimit(4)
+	client3.Write(make([]byte, 10))
+	client3.Write(make([]byte, 10))
+	if msg, err := server3.ReadMessage(); len(msg) != 4 || err != nil {
+		t.Errorf("Unexpected message %d, %v", len(msg), err)
+	}
+	if msg, err := server3.ReadMessage(); msg != nil || err != ErrReadLimit {
+		t.Errorf("Expected ErrReadLimit, got %d, %v", len(msg), err)
+	}
+}
+
+func TestDialFrom(t *testing.T) {
+	listener, err := ListenChan("dialfrom")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	for _, local := range []string{"tenant-7", ""} {
+		dialed := make(chan *ChanConn)
+		go func() {
+			client, err := DialChanFrom(local, "dialfrom")
+			if err != nil {
+				t.Errorf("Failed to dial: %v", err)
+			}
+			dialed <- client
+		}()
+		server, err := listener.AcceptChan()
+		if err != nil {
+			t.Errorf("Failed to accept: %v", err)
+			return
+		}
+		client := <-dialed
+		if client == nil {
+			return
+		}
+		remote := server.RemoteAddr().String()
+		if local != "" && remote != local {
+			t.Errorf("Expected remote address %q, got %q", local, remote)
+		}
+		if local == "" && !strings.HasPrefix(remote, "dialfrom:") {
+			t.Errorf("Unexpected made up address %q", remote)
+		}
+		if client.LocalAddr().String() != remote {
+			t.Errorf("Client address %v differs", client.LocalAddr())
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestWriteCountOnError(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+
+	b := []byte("data")
+	if n, err := client.Write(b); n != len(b) || err != nil {
+		t.Errorf("Unexpected write %d, %v", n, err)
+	}
+
+	// Fill the buffer, so that the deadline is reached while waiting.
+	for len(client.fifo) < cap(client.fifo) {
+		client.Write(b)
+	}
+	client.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	if n, err := client.Write(b); n != 0 || err != ErrWrTimeout {
+		t.Errorf("Expected 0, ErrWrTimeout, got %d, %v", n, err)
+	}
+
+	client.SetWriteDeadline(time.Time{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		server.Close()
+	}()
+	if n, err := client.Write(b); n != 0 || err != ErrConnClosed {
+		t.Errorf("Expected 0, ErrConnClosed, got %d, %v", n, err)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	listener, err := ListenChan("withcontext")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		client, err := DialChan("withcontext")
+		if err == nil {
+			defer client.Close()
+			<-client.Done()
+		}
+	}()
+	server, err := listener.AcceptContext(ctx)
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := server.Read(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected context.Canceled from Read, got %v", err)
+	}
+	if !server.IsClosed() {
+		t.Errorf("Connection not closed")
+	}
+	if _, err := server.Write([]byte("x")); err != context.Canceled {
+		t.Errorf("Expected context.Canceled from Write, got %v", err)
+	}
+
+	// A done context stops the accept itself.
+	if _, err := listener.AcceptContext(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled from Accept, got %v", err)
+	}
+}
+
+func TestConnContext(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	if ctx := server.Context(); ctx != context.Background() {
+		t.Errorf("Expected the background context, got %v", ctx)
+	}
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "request")
+	server.WithContext(ctx)
+	if v := server.Context().Value(key{}); v != "request" {
+		t.Errorf("Expected the attached value, got %v", v)
+	}
+	if client.Context().Value(key{}) != nil {
+		t.Errorf("Context leaked to the peer")
+	}
+}
+
+func expectPanic(t *testing.T, what string, f func()) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("No panic for %s", what)
+		}
+	}()
+	f()
+}
+
+func TestDetachAttach(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	expectPanic(t, "Attach while attached", server.Attach)
+
+	// Hand the server side back and forth, each owner reading a message
+	// and keeping a count in unsynchronized state that travels with it.
+	const rounds = 20
+	go func() {
+		for i := 0; i < rounds; i++ {
+			client.Write([]byte{byte(i)})
+		}
+	}()
+	count := 0
+	handoff := make(chan *ChanConn)
+	done := make(chan struct{}, 2)
+	owner := func(first bool) {
+		defer func() { done <- struct{}{} }()
+		if first {
+			server.Detach()
+			handoff <- server
+		}
+		for conn := range handoff {
+			conn.Attach()
+			b := make([]byte, 1)
+			if n, err := conn.Read(b); n != 1 || err != nil || int(b[0]) != count {
+				t.Errorf("Unexpected read %d, %v, %v after %d", n, err, b, count)
+			}
+			count++
+			conn.Detach()
+			if count == rounds {
+				close(handoff)
+				return
+			}
+			handoff <- conn
+		}
+	}
+	go owner(true)
+	go owner(false)
+	<-done
+	<-done
+	if count != rounds {
+		t.Errorf("Read %d messages, expected %d", count, rounds)
+	}
+
+	expectPanic(t, "Detach while detached", server.Detach)
+	server.Attach()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		expectPanic(t, "Detach during Read", server.Detach)
+		client.Write([]byte("x"))
+	}()
+	server.Read(make([]byte, 1))
+}
+
+func TestSetDeadlineAfterClose(t *testing.T) {
+	client, server := PipeChan()
+	defer server.Close()
+	client.Close()
+
+	before := runtime.NumGoroutine()
+	now := time.Now().Add(time.Second)
+	if err := client.SetDeadline(now); err != ErrConnClosed {
+		t.Errorf("SetDeadline: expected ErrConnClosed, got %v", err)
+	}
+	if err := client.SetReadDeadline(now); err != ErrConnClosed {
+		t.Errorf("SetReadDeadline: expected ErrConnClosed, got %v", err)
+	}
+	if err := client.SetWriteDeadline(now); err != ErrConnClosed {
+		t.Errorf("SetWriteDeadline: expected ErrConnClosed, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.SetDeadlineFromContext(ctx); err != ErrConnClosed {
+		t.Errorf("SetDeadlineFromContext: expected ErrConnClosed, got %v", err)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Goroutines grew from %d to %d", before, n)
+	}
+
+	// A half-closed connection may still have its deadlines set.
+	c1, c2 := PipeChan()
+	defer c1.Close()
+	defer c2.Close()
+	c1.CloseWrite()
+	if err := c1.SetDeadline(now); err != nil {
+		t.Errorf("SetDeadline on a half-closed connection: %v", err)
+	}
+}
+
+func TestAcceptCancel(t *testing.T) {
+	listener, err := ListenChan("acceptcancel")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := listener.AcceptChan()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	listener.Cancel()
+	err = <-done
+	if err != ErrAcceptCancelled {
+		t.Errorf("Expected ErrAcceptCancelled, got %v", err)
+		return
+	}
+	if ne := err.(net.Error); ne.Temporary() || ne.Timeout() {
+		t.Errorf("Unexpected flags on %v", err)
+	}
+
+	go func() {
+		client, err := DialChan("acceptcancel")
+		if err == nil {
+			client.Close()
+		}
+		done <- err
+	}()
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Accept after Cancel failed: %v", err)
+		return
+	}
+	server.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Dial failed: %v", err)
+	}
+}
+
+func TestCopyInvariant(t *testing.T) {
+	big := make([]byte, 100001)
+	rand.Read(big)
+
+	for _, size := range []int{1, 4095, 4096, 32768, 32769, len(big)} {
+		for _, max := range []int{0, 1000, 4096} {
+			for _, rdbuf := range []int{0, 8192} {
+				testCopyInvariant(t, string(big[:size]), max, rdbuf, false)
+				testCopyInvariant(t, string(big[:size]), max, rdbuf, true)
+			}
+		}
+	}
+}
+
+// testCopyInvariant checks that want survives being copied with io.Copy,
+// which uses WriteString, or with plain 32 KB writes if hide is set.
+func testCopyInvariant(t *testing.T, want string, max, rdbuf int, hide bool) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+	client.SetMaxMessageSize(max, true)
+	server.SetReadBuffer(rdbuf)
+
+	var src io.Reader = strings.NewReader(want)
+	if hide {
+		src = struct{ io.Reader }{src}
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(client, src)
+		client.CloseWrite()
+		errs <- err
+	}()
+
+	// Read through a small buffer, to cross message boundaries at odd
+	// places.
+	var got bytes.Buffer
+	_, err := io.CopyBuffer(&got, struct{ io.Reader }{server},
+		make([]byte, 777))
+	if err == nil {
+		err = <-errs
+	}
+	if err != nil || got.String() != want {
+		t.Errorf("Copy of %d bytes, max %d, rdbuf %d, hide %v differs: %v",
+			len(want), max, rdbuf, hide, err)
+	}
+}
+
+func TestListenerStats(t *testing.T) {
+	listener, err := ListenChan("listenerstats")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	st := listener.Stats()
+	if st.CreatedAt.IsZero() || !st.LastAcceptAt.IsZero() {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+
+	time.Sleep(time.Millisecond)
+	go func() {
+		client, err := DialChan("listenerstats")
+		if err == nil {
+			client.Close()
+		}
+	}()
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+	server.Close()
+	st = listener.Stats()
+	if !st.LastAcceptAt.After(st.CreatedAt) {
+		t.Errorf("LastAcceptAt did not advance: %+v", st)
+	}
+}
+
+func TestListenerCounters(t *testing.T) {
+	listener, err := (&ListenConfig{Backlog: 2}).Listen("listenercounters")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	// Abandoned requests still take up the backlog until accepted.
+	for i := 0; i < 2; i++ {
+		if _, err := TryDialChan("listenercounters"); err != ErrWouldBlock {
+			t.Errorf("Expected ErrWouldBlock, got %v", err)
+			return
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := TryDialChan("listenercounters"); err != ErrListenQFull {
+			t.Errorf("Expected ErrListenQFull, got %v", err)
+			return
+		}
+	}
+
+	listener.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := listener.AcceptChan(); err != ErrAcceptTimeout {
+		t.Errorf("Expected ErrAcceptTimeout, got %v", err)
+		return
+	}
+
+	st := listener.Stats()
+	if st.QueueFull != 3 || st.AcceptTimeouts != 1 || st.Refused != 0 {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+}
+
+func TestListenerReadTimeout(t *testing.T) {
+	listener, err := ListenChan("listenerrdtmo")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+	listener.ReadTimeout = 20 * time.Millisecond
+
+	dialed := make(chan *ChanConn, 1)
+	go func() {
+		client, _ := DialChan("listenerrdtmo")
+		dialed <- client
+	}()
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+	defer server.Close()
+	if client := <-dialed; client != nil {
+		defer client.Close()
+	}
+
+	start := time.Now()
+	if _, err := server.Read(make([]byte, 10)); err != ErrRdTimeout {
+		t.Errorf("Expected ErrRdTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Read took %v", d)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		got, err := server.Handshake([]byte("hello client"), time.Second)
+		if err != nil || string(got) != "hello server" {
+			t.Errorf("Server got %q, %v", got, err)
+		}
+	}()
+	got, err := client.Handshake([]byte("hello server"), time.Second)
+	if err != nil || string(got) != "hello client" {
+		t.Errorf("Client got %q, %v", got, err)
+	}
+	<-done
+
+	// Nobody answers this time.
+	_, err = client.Handshake([]byte("anyone?"), 20*time.Millisecond)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	client.mtx.Lock()
+	rd := client.rdeadline
+	client.mtx.Unlock()
+	if !rd.IsZero() {
+		t.Errorf("Read deadline was not restored")
+	}
+}
+
+func TestListenConfig(t *testing.T) {
+	lc := ListenConfig{Backlog: 5, BufferDepth: 3}
+	for _, name := range []string{"listenconfig.a", "listenconfig.b"} {
+		listener, err := lc.Listen(name)
+		if err != nil {
+			t.Errorf("Failed to listen: %v", err)
+			return
+		}
+		defer listener.Close()
+		if listener.QueueCap() != 5 {
+			t.Errorf("Expected a backlog of 5, got %d", listener.QueueCap())
+		}
+		go func() {
+			client, err := DialChan(name)
+			if err == nil {
+				client.Close()
+			}
+		}()
+		server, err := listener.AcceptChan()
+		if err != nil {
+			t.Errorf("Failed to accept: %v", err)
+			return
+		}
+		if cap(server.fifo) != 3 {
+			t.Errorf("Expected a buffer depth of 3, got %d", cap(server.fifo))
+		}
+		server.Close()
+	}
+}
+
+func TestListenMaxConns(t *testing.T) {
+	lc := ListenConfig{MaxConns: 1}
+	listener, err := lc.Listen("maxconns")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+	listener.SetDeadline(time.Now().Add(time.Second))
+
+	// The clients stay open until the end.
+	stop := make(chan bool)
+	defer close(stop)
+	dial := func() chan error {
+		done := make(chan error, 1)
+		go func() {
+			client, err := DialChan("maxconns")
+			done <- err
+			if err == nil {
+				<-stop
+				client.Close()
+			}
+		}()
+		return done
+	}
+
+	d1 := dial()
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+	if err := <-d1; err != nil {
+		t.Errorf("Dial failed: %v", err)
+	}
+
+	d2 := dial()
+	listener.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := listener.AcceptChan(); err != ErrAcceptTimeout {
+		t.Errorf("Expected ErrAcceptTimeout, got %v", err)
+	}
+	if err := <-d2; err != ErrConnRefused {
+		t.Errorf("Expected ErrConnRefused over the limit, got %v", err)
+	}
+
+	server.Close()
+	d3 := dial()
+	listener.SetDeadline(time.Now().Add(time.Second))
+	if server, err = listener.AcceptChan(); err != nil {
+		t.Errorf("Failed to accept after a close: %v", err)
+		return
+	}
+	server.Close()
+	if err := <-d3; err != nil {
+		t.Errorf("Dial failed: %v", err)
+	}
+}
+
+func TestReadPendingThenTimeout(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+	server.SetReadBuffer(1024)
+
+	client.Write([]byte("0123456789abc"))
+	b := make([]byte, 10)
+	if n, err := server.Read(b); n != 10 || err != nil {
+		t.Errorf("Unexpected read %d, %v", n, err)
+		return
+	}
+
+	// Three bytes remain, and nothing more will come.
+	server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if n, err := server.Read(b); n != 3 || err != nil ||
+		string(b[:n]) != "abc" {
+		t.Errorf("Expected the remaining data without error, got %q, %v",
+			b[:n], err)
+	}
+	if n, err := server.Read(b); n != 0 || err != ErrRdTimeout {
+		t.Errorf("Expected 0, ErrRdTimeout, got %d, %v", n, err)
+	}
+}
+
+func TestPastReadDeadline(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+	server.SetReadBuffer(1024)
+
+	client.Write([]byte("queued"))
+	server.SetReadDeadline(time.Now().Add(-time.Second))
+	b := make([]byte, 10)
+	for i := 0; i < 1000; i++ {
+		if n, err := server.Read(b); n != 0 || err != ErrRdTimeout {
+			t.Errorf("Expected 0, ErrRdTimeout, got %d, %v", n, err)
+			return
+		}
+	}
+
+	// Data already taken from the channel is still returned, but no more.
+	server.SetReadDeadline(time.Time{})
+	client.Write([]byte("more"))
+	if n, err := server.Read(b[:2]); n != 2 || err != nil {
+		t.Errorf("Unexpected read %d, %v", n, err)
+		return
+	}
+	server.SetReadDeadline(time.Now().Add(-time.Second))
+	if n, err := server.Read(b); n != 4 || err != nil ||
+		string(b[:n]) != "eued" {
+		t.Errorf("Expected the pending data, got %q, %v", b[:n], err)
+	}
+	if n, err := server.Read(b); n != 0 || err != ErrRdTimeout {
+		t.Errorf("Expected 0, ErrRdTimeout, got %d, %v", n, err)
+	}
+}
+
+func TestAcceptN(t *testing.T) {
+	listener, err := ListenChan("acceptn")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	for i := 0; i < 3; i++ {
+		go func() {
+			if client, err := DialChan("acceptn"); err == nil {
+				defer client.Close()
+				client.Read(make([]byte, 1))
+			}
+		}()
+	}
+	conns, err := listener.AcceptN(3)
+	if err != nil || len(conns) != 3 {
+		t.Errorf("Unexpected accept %d, %v", len(conns), err)
+		return
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	// Only one more comes, so the deadline cuts it short.
+	go func() {
+		if client, err := DialChan("acceptn"); err == nil {
+			client.Close()
+		}
+	}()
+	listener.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	conns, err = listener.AcceptN(2)
+	if err != ErrAcceptTimeout || len(conns) != 1 {
+		t.Errorf("Unexpected accept %d, %v", len(conns), err)
+		return
+	}
+	conns[0].Close()
+}
+
+func TestConcurrentAccept(t *testing.T) {
+	lc := ListenConfig{Backlog: 128}
+	listener, err := lc.Listen("concurrentaccept")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	var mtx sync.Mutex
+	var onAccept int
+	listener.OnAccept = func(*ChanConn) {
+		mtx.Lock()
+		onAccept++
+		mtx.Unlock()
+	}
+	listener.AcceptFilter = func([]byte) error { return nil }
+
+	const dials = 100
+	ids := make(chan byte, dials)
+	conns := make(chan *ChanConn, dials)
+	var acceptors sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		acceptors.Add(1)
+		go func() {
+			defer acceptors.Done()
+			for {
+				server, meta, err := listener.AcceptChanMeta()
+				if err != nil {
+					return
+				}
+				conns <- server
+				ids <- meta[0]
+			}
+		}()
+	}
+
+	var dialers sync.WaitGroup
+	for i := 0; i < dials; i++ {
+		dialers.Add(1)
+		go func(id byte) {
+			defer dialers.Done()
+			client, err := DialChanMeta("concurrentaccept", []byte{id})
+			if err != nil {
+				t.Errorf("Dial %d failed: %v", id, err)
+				return
+			}
+			client.Close()
+		}(byte(i))
+	}
+	dialers.Wait()
+	listener.Close()
+	acceptors.Wait()
+	close(ids)
+	close(conns)
+
+	seen := make(map[byte]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("Dial %d accepted twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != dials {
+		t.Errorf("Accepted %d dials, expected %d", len(seen), dials)
+	}
+	unique := make(map[*ChanConn]bool)
+	for c := range conns {
+		unique[c] = true
+	}
+	if len(unique) != dials || onAccept != dials {
+		t.Errorf("Got %d distinct connections, %d OnAccept calls",
+			len(unique), onAccept)
+	}
+}
+
+func TestCloseReadGraceful(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	for i := 0; i < 5; i++ {
+		client.Write([]byte{byte(i)})
+	}
+	server.CloseReadGraceful(10 * time.Millisecond)
+
+	// Reading works as usual during the grace period.
+	b := make([]byte, 10)
+	if n, err := server.Read(b); n != 1 || err != nil || b[0] != 0 {
+		t.Errorf("Unexpected read %d, %v", n, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := client.Write([]byte{9}); err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed from peer, got %v", err)
+	}
+	for i := 1; i < 5; i++ {
+		if n, err := server.Read(b); n != 1 || err != nil || b[0] != byte(i) {
+			t.Errorf("Unexpected read %d, %v, %v", n, err, b[:n])
+			return
+		}
+	}
+	if _, err := server.Read(b); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestCloseReadGracefulDrain(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	client.Write([]byte("ab"))
+	client.Write([]byte("c"))
+	server.CloseReadGraceful(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	// Every way of reading drains what was buffered.
+	if b, err := server.Peek(1); err != nil || string(b) != "a" {
+		t.Errorf("Unexpected peek %q, %v", b, err)
+	}
+	if msg, err := server.ReadMessage(); err != nil || string(msg) != "ab" {
+		t.Errorf("Unexpected message %q, %v", msg, err)
+	}
+	b := make([]byte, 10)
+	if n, err := server.Read(b); err != nil || string(b[:n]) != "c" {
+		t.Errorf("Unexpected read %q, %v", b[:n], err)
+	}
+	if _, err := server.ReadMessage(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestCloseReadGracefulThenClose(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+
+	client.Write([]byte("x"))
+	server.CloseReadGraceful(10 * time.Millisecond)
+	server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// The grace period ended with the Close, so nothing can be read.
+	if n, err := server.Read(make([]byte, 10)); n != 0 || err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed, got %d, %v", n, err)
+	}
+}
+
+func TestCloseReadGracefulBlocked(t *testing.T) {
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := server.Read(make([]byte, 10))
+		done <- err
+	}()
+	server.CloseReadGraceful(10 * time.Millisecond)
+	if err := <-done; err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestNilPeer(t *testing.T) {
+	conn, _ := PipeChan()
+	conn.peer = nil
+
+	if _, err := conn.Write([]byte("data")); err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed from Write, got %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 10)); err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed from Read, got %v", err)
+	}
+	if !conn.IsClosed() || !conn.PeerWriteClosed() {
+		t.Errorf("Connection without a peer not reported closed")
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		t.Errorf("Unexpected remote address %v", addr)
+	}
+	if err := conn.Flush(); err != ErrConnClosed {
+		t.Errorf("Expected ErrConnClosed from Flush, got %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
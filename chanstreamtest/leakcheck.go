@@ -0,0 +1,53 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chanstreamtest provides helpers for testing code that uses
+// chanstream.
+package chanstreamtest
+
+import "strings"
+import "testing"
+import "time"
+
+import "github.com/gdamore/chanstream"
+
+// leakGrace is how long LeakCheck waits for connections and listeners
+// that are still being closed, say by a server goroutine, before failing.
+const leakGrace = 200 * time.Millisecond
+
+// LeakCheck notes the listeners and connections that are open, and
+// registers a cleanup with t that fails the test if, by the time it ends,
+// any others have been left open, as found by chanstream.LeakSnapshot.
+// This catches tests that forget to close what they open, and is best
+// called first thing in a test:
+//
+//	func TestSomething(t *testing.T) {
+//		chanstreamtest.LeakCheck(t)
+//		...
+//	}
+func LeakCheck(t testing.TB) {
+	t.Helper()
+	s := chanstream.TrackLeaks()
+	t.Cleanup(func() {
+		listeners, conns := s.Leaked(leakGrace)
+		if len(listeners) > 0 {
+			t.Errorf("Leaked %d listeners: %s", len(listeners),
+				strings.Join(listeners, ", "))
+		}
+		if len(conns) > 0 {
+			t.Errorf("Leaked %d connections: %s", len(conns),
+				strings.Join(conns, ", "))
+		}
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstreamtest
+
+import "fmt"
+import "strings"
+import "testing"
+
+import "github.com/gdamore/chanstream"
+
+// leakT records what LeakCheck reports, rather than failing the test.
+type leakT struct {
+	testing.TB
+	cleanup func()
+	errs    []string
+}
+
+func (lt *leakT) Helper() {}
+
+func (lt *leakT) Cleanup(f func()) {
+	lt.cleanup = f
+}
+
+func (lt *leakT) Errorf(format string, args ...interface{}) {
+	lt.errs = append(lt.errs, fmt.Sprintf(format, args...))
+}
+
+func TestLeakCheck(t *testing.T) {
+	lt := &leakT{TB: t}
+	LeakCheck(lt)
+	listener, err := chanstream.ListenChan("leakcheck")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	go func() {
+		if client, err := chanstream.DialChan("leakcheck"); err == nil {
+			client.Close()
+		}
+	}()
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+	lt.cleanup()
+	if len(lt.errs) != 2 ||
+		!strings.HasPrefix(lt.errs[0], "Leaked 1 listeners: leakcheck") ||
+		!strings.HasPrefix(lt.errs[1], "Leaked 1 connections: leakcheck->") {
+		t.Errorf("Unexpected reports %q", lt.errs)
+	}
+	server.Close()
+	listener.Close()
+}
+
+func TestLeakCheckClean(t *testing.T) {
+	LeakCheck(t)
+	listener, err := chanstream.ListenChan("leakcheck.clean")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+	go func() {
+		if client, err := chanstream.DialChan("leakcheck.clean"); err == nil {
+			client.Close()
+		}
+	}()
+	server, err := listener.AcceptChan()
+	if err != nil {
+		t.Errorf("Failed to accept: %v", err)
+		return
+	}
+	server.Close()
+}
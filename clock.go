@@ -0,0 +1,79 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "sync/atomic"
+import "time"
+
+// Clock is a source of time, used for deadlines, timeouts and timestamps.
+// Replacing the real clock with SetClock allows code that depends on
+// timeouts to be tested deterministically, by advancing time by hand,
+// rather than sleeping.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc calls f in its own goroutine once d has passed, like
+	// time.AfterFunc.  The returned function stops that from happening,
+	// and reports whether it did.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// realClock is the Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// clockHolder wraps the Clock, as atomic.Value needs a consistent type.
+type clockHolder struct {
+	Clock
+}
+
+var clock atomic.Value
+
+func init() {
+	clock.Store(clockHolder{realClock{}})
+}
+
+// SetClock replaces the clock used by the package, and returns the one it
+// replaced.  A nil Clock restores the real one.  It affects deadlines and
+// timers started after the call, so it is best called before anything is
+// listening, and restored once done, typically by a test.  The short
+// delay used to coalesce writes, see SetNoDelay, always uses the real
+// clock, so that buffered data is not held back indefinitely.
+func SetClock(c Clock) Clock {
+	if c == nil {
+		c = realClock{}
+	}
+	old := clock.Load().(clockHolder)
+	clock.Store(clockHolder{c})
+	return old.Clock
+}
+
+// now returns the current time, according to the clock.
+func now() time.Time {
+	return clock.Load().(clockHolder).Now()
+}
+
+// afterFunc calls f once d has passed, according to the clock.
+func afterFunc(d time.Duration, f func()) func() bool {
+	return clock.Load().(clockHolder).AfterFunc(d, f)
+}
@@ -0,0 +1,190 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "runtime"
+import "sync"
+import "testing"
+import "time"
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	mtx    sync.Mutex
+	t      time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	when time.Time
+	f    func()
+	done bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mtx.Lock()
+	defer fc.mtx.Unlock()
+	return fc.t
+}
+
+func (fc *fakeClock) AfterFunc(d time.Duration, f func()) func() bool {
+	fc.mtx.Lock()
+	defer fc.mtx.Unlock()
+	tm := &fakeTimer{when: fc.t.Add(d), f: f}
+	fc.timers = append(fc.timers, tm)
+	return func() bool {
+		fc.mtx.Lock()
+		defer fc.mtx.Unlock()
+		stopped := !tm.done
+		tm.done = true
+		return stopped
+	}
+}
+
+// Advance moves the clock on by d, firing the timers that fall due.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mtx.Lock()
+	fc.t = fc.t.Add(d)
+	var due []func()
+	for _, tm := range fc.timers {
+		if !tm.done && !tm.when.After(fc.t) {
+			tm.done = true
+			due = append(due, tm.f)
+		}
+	}
+	fc.mtx.Unlock()
+	for _, f := range due {
+		go f()
+	}
+}
+
+// pending returns the number of timers that have neither fired nor been
+// stopped.
+func (fc *fakeClock) pending() int {
+	fc.mtx.Lock()
+	defer fc.mtx.Unlock()
+	pending := 0
+	for _, tm := range fc.timers {
+		if !tm.done {
+			pending++
+		}
+	}
+	return pending
+}
+
+// waitTimers waits until at least n timers are pending, so that whatever
+// is to be timed out is known to be waiting.
+func (fc *fakeClock) waitTimers(n int) {
+	for fc.pending() < n {
+		runtime.Gosched()
+	}
+}
+
+func TestFakeClockReadTimeout(t *testing.T) {
+	fc := newFakeClock()
+	defer SetClock(SetClock(fc))
+
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	server.SetReadDeadline(fc.Now().Add(time.Hour))
+	errs := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 10))
+		errs <- err
+	}()
+	fc.waitTimers(1)
+	select {
+	case err := <-errs:
+		t.Errorf("Read returned early: %v", err)
+		return
+	default:
+	}
+	fc.Advance(time.Hour)
+	if err := <-errs; err != ErrRdTimeout {
+		t.Errorf("Expected ErrRdTimeout, got %v", err)
+	}
+}
+
+func TestFakeClockWriteTimeout(t *testing.T) {
+	fc := newFakeClock()
+	defer SetClock(SetClock(fc))
+
+	client, server := PipeChan()
+	defer client.Close()
+	defer server.Close()
+
+	// Fill the buffer, so that the next Write blocks.
+	for i := 0; i < cap(client.fifo); i++ {
+		if _, err := client.Write([]byte("x")); err != nil {
+			t.Errorf("Failed to write: %v", err)
+			return
+		}
+	}
+	client.SetWriteDeadline(fc.Now().Add(time.Minute))
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Write([]byte("x"))
+		errs <- err
+	}()
+	fc.waitTimers(1)
+	fc.Advance(time.Minute)
+	if err := <-errs; err != ErrWrTimeout {
+		t.Errorf("Expected ErrWrTimeout, got %v", err)
+	}
+}
+
+func TestFakeClockAcceptTimeout(t *testing.T) {
+	fc := newFakeClock()
+	defer SetClock(SetClock(fc))
+
+	listener, err := ListenChan("fakeclock.accept")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	listener.SetDeadline(fc.Now().Add(time.Second))
+	errs := make(chan error, 1)
+	go func() {
+		_, err := listener.AcceptChan()
+		errs <- err
+	}()
+	fc.waitTimers(1)
+	fc.Advance(time.Second)
+	if err := <-errs; err != ErrAcceptTimeout {
+		t.Errorf("Expected ErrAcceptTimeout, got %v", err)
+	}
+	if st := listener.Stats(); !st.CreatedAt.Equal(fc.Now().Add(-time.Second)) {
+		t.Errorf("CreatedAt %v does not follow the clock", st.CreatedAt)
+	}
+}
+
+func TestSetClockNil(t *testing.T) {
+	fc := newFakeClock()
+	old := SetClock(fc)
+	if SetClock(nil) != fc {
+		t.Errorf("SetClock did not return the previous clock")
+	}
+	SetClock(old)
+	if d := time.Since(now()); d < 0 || d > time.Minute {
+		t.Errorf("Real clock not restored, off by %v", d)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "net"
+import "sync"
+import "time"
+
+// ErrFaultInjected is reported by a FaultConn for a failure it injects.
+var ErrFaultInjected = &ChanError{err: "Injected fault."}
+
+// FaultConn wraps a ChanConn to inject latency, errors, and short reads and
+// writes, deterministically.  This allows testing how code built on
+// chanstream copes with an unreliable transport.  It implements net.Conn,
+// and with no faults configured behaves just like the wrapped connection.
+// Only the net.Conn methods are provided, so that nothing bypasses the
+// faults; use io.WriteString and the like rather than the extra methods of
+// ChanConn.  The knobs should be set before the connection is used.
+type FaultConn struct {
+	conn *ChanConn
+
+	// ReadLatency and WriteLatency delay each Read and Write.
+	ReadLatency  time.Duration
+	WriteLatency time.Duration
+
+	// MaxReadChunk, if not zero, limits how much a single Read returns.
+	MaxReadChunk int
+
+	mtx       sync.Mutex
+	readLeft  int
+	writeLeft int
+}
+
+// NewFaultConn returns a FaultConn wrapping conn, with no faults.
+func NewFaultConn(conn *ChanConn) *FaultConn {
+	return &FaultConn{conn: conn, readLeft: -1, writeLeft: -1}
+}
+
+// FailReadAfter makes Reads fail with ErrFaultInjected once n more bytes
+// have been read.  A Read that would cross the limit is cut short.  A
+// negative n removes the limit.
+func (f *FaultConn) FailReadAfter(n int) {
+	f.mtx.Lock()
+	f.readLeft = n
+	f.mtx.Unlock()
+}
+
+// FailWriteAfter makes Writes fail with ErrFaultInjected once n more bytes
+// have been written.  A Write that would cross the limit writes only the
+// bytes up to it, and fails.  A negative n removes the limit.
+func (f *FaultConn) FailWriteAfter(n int) {
+	f.mtx.Lock()
+	f.writeLeft = n
+	f.mtx.Unlock()
+}
+
+// Read reads from the wrapped connection, applying the faults.
+func (f *FaultConn) Read(b []byte) (int, error) {
+	if f.ReadLatency > 0 {
+		time.Sleep(f.ReadLatency)
+	}
+	if f.MaxReadChunk > 0 && len(b) > f.MaxReadChunk {
+		b = b[:f.MaxReadChunk]
+	}
+	f.mtx.Lock()
+	left := f.readLeft
+	f.mtx.Unlock()
+	if left == 0 {
+		return 0, ErrFaultInjected
+	}
+	if left > 0 && len(b) > left {
+		b = b[:left]
+	}
+	n, err := f.conn.Read(b)
+	f.mtx.Lock()
+	if f.readLeft > 0 {
+		f.readLeft -= n
+	}
+	f.mtx.Unlock()
+	return n, err
+}
+
+// Write writes to the wrapped connection, applying the faults.
+func (f *FaultConn) Write(b []byte) (int, error) {
+	if f.WriteLatency > 0 {
+		time.Sleep(f.WriteLatency)
+	}
+	f.mtx.Lock()
+	left := f.writeLeft
+	f.mtx.Unlock()
+	short := left >= 0 && len(b) > left
+	if short {
+		b = b[:left]
+	}
+	n := 0
+	var err error
+	if len(b) > 0 {
+		n, err = f.conn.Write(b)
+	}
+	f.mtx.Lock()
+	if f.writeLeft > 0 {
+		f.writeLeft -= n
+	}
+	f.mtx.Unlock()
+	if err == nil && short {
+		err = ErrFaultInjected
+	}
+	return n, err
+}
+
+// Close closes the wrapped connection.
+func (f *FaultConn) Close() error {
+	return f.conn.Close()
+}
+
+// LocalAddr returns the local address of the wrapped connection.
+func (f *FaultConn) LocalAddr() net.Addr {
+	return f.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the wrapped connection.
+func (f *FaultConn) RemoteAddr() net.Addr {
+	return f.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the wrapped connection.
+func (f *FaultConn) SetDeadline(t time.Time) error {
+	return f.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the wrapped connection.
+func (f *FaultConn) SetReadDeadline(t time.Time) error {
+	return f.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the wrapped connection.
+func (f *FaultConn) SetWriteDeadline(t time.Time) error {
+	return f.conn.SetWriteDeadline(t)
+}
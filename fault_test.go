@@ -0,0 +1,135 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "bytes"
+import "io"
+import "net"
+import "testing"
+import "time"
+
+func TestFaultConnNoFaults(t *testing.T) {
+	c1, c2 := PipeChan()
+	var conn net.Conn = NewFaultConn(c1)
+	defer conn.Close()
+	defer c2.Close()
+
+	want := bytes.Repeat([]byte("fault free "), 1000)
+	go func() {
+		conn.Write(want)
+		c1.CloseWrite()
+	}()
+	got, err := io.ReadAll(c2)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("Data differs, %v", err)
+	}
+}
+
+func TestFaultConnLatency(t *testing.T) {
+	c1, c2 := PipeChan()
+	f := NewFaultConn(c1)
+	defer f.Close()
+	defer c2.Close()
+
+	f.ReadLatency = 20 * time.Millisecond
+	f.WriteLatency = 20 * time.Millisecond
+	start := time.Now()
+	f.Write([]byte("slow"))
+	if d := time.Since(start); d < f.WriteLatency {
+		t.Errorf("Write took only %v", d)
+	}
+	c2.Write([]byte("slow"))
+	start = time.Now()
+	f.Read(make([]byte, 10))
+	if d := time.Since(start); d < f.ReadLatency {
+		t.Errorf("Read took only %v", d)
+	}
+}
+
+func TestFaultConnShortReads(t *testing.T) {
+	c1, c2 := PipeChan()
+	f := NewFaultConn(c1)
+	defer f.Close()
+	defer c2.Close()
+
+	f.MaxReadChunk = 3
+	c2.Write([]byte("abcdefgh"))
+	b := make([]byte, 10)
+	for _, want := range []string{"abc", "def", "gh"} {
+		if n, err := f.Read(b); err != nil || string(b[:n]) != want {
+			t.Errorf("Expected %q, got %q, %v", want, b[:n], err)
+		}
+	}
+}
+
+func TestFaultConnFailRead(t *testing.T) {
+	c1, c2 := PipeChan()
+	f := NewFaultConn(c1)
+	defer f.Close()
+	defer c2.Close()
+
+	f.FailReadAfter(5)
+	c2.Write([]byte("abcdefgh"))
+	b := make([]byte, 10)
+	if n, err := f.Read(b); err != nil || string(b[:n]) != "abcde" {
+		t.Errorf("Unexpected read %q, %v", b[:n], err)
+	}
+	if n, err := f.Read(b); n != 0 || err != ErrFaultInjected {
+		t.Errorf("Expected ErrFaultInjected, got %d, %v", n, err)
+	}
+	f.FailReadAfter(-1)
+	if n, err := f.Read(b); err != nil || string(b[:n]) != "fgh" {
+		t.Errorf("Unexpected read %q, %v", b[:n], err)
+	}
+}
+
+func TestFaultConnFailWrite(t *testing.T) {
+	c1, c2 := PipeChan()
+	f := NewFaultConn(c1)
+	defer f.Close()
+	defer c2.Close()
+
+	f.FailWriteAfter(6)
+	if n, err := f.Write([]byte("abcd")); n != 4 || err != nil {
+		t.Errorf("Unexpected write %d, %v", n, err)
+	}
+	if n, err := f.Write([]byte("efgh")); n != 2 || err != ErrFaultInjected {
+		t.Errorf("Expected a short write, got %d, %v", n, err)
+	}
+	if n, err := f.Write([]byte("ijkl")); n != 0 || err != ErrFaultInjected {
+		t.Errorf("Expected ErrFaultInjected, got %d, %v", n, err)
+	}
+	c1.CloseWrite()
+	if got, err := io.ReadAll(c2); err != nil || string(got) != "abcdef" {
+		t.Errorf("Peer received %q, %v", got, err)
+	}
+}
+
+func TestFaultConnNoBypass(t *testing.T) {
+	c1, c2 := PipeChan()
+	f := NewFaultConn(c1)
+	defer f.Close()
+	defer c2.Close()
+
+	f.FailWriteAfter(0)
+	if n, err := io.WriteString(f, "bypass"); n != 0 || err != ErrFaultInjected {
+		t.Errorf("Expected ErrFaultInjected, got %d, %v", n, err)
+	}
+	c2.Write([]byte("data"))
+	f.FailReadAfter(0)
+	if n, err := io.ReadFull(f, make([]byte, 4)); n != 0 || err != ErrFaultInjected {
+		t.Errorf("Expected ErrFaultInjected, got %d, %v", n, err)
+	}
+}
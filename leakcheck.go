@@ -0,0 +1,129 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "fmt"
+import "sort"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// openConns tracks the connections that have not been closed, for
+// LeakSnapshot.  Connections are only tracked while a snapshot is active,
+// as counted by checks, so that otherwise the map neither keeps them
+// alive nor costs anything.
+var openConns struct {
+	checks int32
+	mtx    sync.Mutex
+	m      map[*ChanConn]struct{}
+}
+
+// track records conns as open, if a LeakSnapshot is active.
+func track(conns ...*ChanConn) {
+	if atomic.LoadInt32(&openConns.checks) == 0 {
+		return
+	}
+	openConns.mtx.Lock()
+	if openConns.m == nil {
+		openConns.m = make(map[*ChanConn]struct{})
+	}
+	for _, conn := range conns {
+		conn.tracked = true
+		openConns.m[conn] = struct{}{}
+	}
+	openConns.mtx.Unlock()
+}
+
+// untrack records conn as closed.  The caller must only call it for a
+// tracked conn.
+func untrack(conn *ChanConn) {
+	openConns.mtx.Lock()
+	delete(openConns.m, conn)
+	openConns.mtx.Unlock()
+}
+
+// LeakSnapshot notes the listeners and connections that are open at some
+// point, so that any opened later and left open can be found.  Test
+// helpers such as chanstreamtest.LeakCheck use it to catch tests that
+// forget to close what they open.  A connection counts as open until
+// both its read and write sides have been closed, whether by Close or by
+// CloseRead and CloseWrite.  Only connections made while a snapshot is
+// active, between TrackLeaks and Leaked, are tracked.
+type LeakSnapshot struct {
+	conns map[*ChanConn]bool
+	names map[string]bool
+	once  sync.Once
+}
+
+// TrackLeaks starts tracking connections, and returns a snapshot of those
+// already open, and of the registered listener names.
+func TrackLeaks() *LeakSnapshot {
+	atomic.AddInt32(&openConns.checks, 1)
+	s := &LeakSnapshot{
+		conns: make(map[*ChanConn]bool),
+		names: make(map[string]bool),
+	}
+	for _, conn := range leakedConns(nil) {
+		s.conns[conn] = true
+	}
+	for _, name := range ListListeners() {
+		s.names[name] = true
+	}
+	return s
+}
+
+// Leaked returns the names of the listeners, and the addresses of the
+// connections, as "local->remote", that have been opened since the
+// snapshot and are still open, each sorted.  It waits up to grace for
+// them to be closed, say by a server goroutine, before reporting them.
+// It also stops tracking, once for each snapshot.
+func (s *LeakSnapshot) Leaked(grace time.Duration) (listeners, conns []string) {
+	defer s.once.Do(func() { atomic.AddInt32(&openConns.checks, -1) })
+	var lc []*ChanConn
+	end := time.Now().Add(grace)
+	for {
+		lc = leakedConns(s.conns)
+		listeners = listeners[:0]
+		for _, name := range ListListeners() {
+			if !s.names[name] {
+				listeners = append(listeners, name)
+			}
+		}
+		if (len(lc) == 0 && len(listeners) == 0) || time.Now().After(end) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for _, conn := range lc {
+		conns = append(conns, fmt.Sprintf("%s->%s", conn.LocalAddr(),
+			conn.RemoteAddr()))
+	}
+	sort.Strings(listeners)
+	sort.Strings(conns)
+	return listeners, conns
+}
+
+// leakedConns returns the open connections that are not in baseline.
+func leakedConns(baseline map[*ChanConn]bool) []*ChanConn {
+	openConns.mtx.Lock()
+	defer openConns.mtx.Unlock()
+	var conns []*ChanConn
+	for conn := range openConns.m {
+		if !baseline[conn] {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
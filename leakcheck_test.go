@@ -0,0 +1,75 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "strings"
+import "testing"
+import "time"
+
+// leakCheck is like chanstreamtest.LeakCheck, which cannot be used by the
+// tests of this package, as it imports it.
+func leakCheck(t *testing.T) {
+	s := TrackLeaks()
+	t.Cleanup(func() {
+		listeners, conns := s.Leaked(200 * time.Millisecond)
+		if len(listeners) > 0 || len(conns) > 0 {
+			t.Errorf("Leaked listeners %q, connections %q", listeners, conns)
+		}
+	})
+}
+
+func TestLeakSnapshot(t *testing.T) {
+	s := TrackLeaks()
+	client, server := mkPair(t, "leakcheck")
+	client.Close()
+	listeners, conns := s.Leaked(0)
+	if len(listeners) != 1 || listeners[0] != "leakcheck" ||
+		len(conns) != 1 || !strings.HasPrefix(conns[0], "leakcheck->") {
+		t.Errorf("Unexpected leaks %q, %q", listeners, conns)
+	}
+
+	// Once everything is closed, there is nothing to report.
+	server.Close()
+	ResetRegistry()
+	s = TrackLeaks()
+	client, server = PipeChan()
+	client.Close()
+	server.Close()
+	if listeners, conns := s.Leaked(0); len(listeners) != 0 || len(conns) != 0 {
+		t.Errorf("Unexpected leaks %q, %q", listeners, conns)
+	}
+}
+
+func TestLeakSnapshotHalfClose(t *testing.T) {
+	client, server := PipeChan()
+	if client.tracked || server.tracked {
+		t.Errorf("Connections tracked without a LeakSnapshot")
+	}
+	client.Close()
+	server.Close()
+
+	s := TrackLeaks()
+	client, server = PipeChan()
+	client.CloseRead()
+	client.CloseWrite()
+	server.CloseRead()
+	server.CloseWrite()
+	if n := len(leakedConns(nil)); n != 0 {
+		t.Errorf("%d connections still tracked after CloseRead and CloseWrite", n)
+	}
+	if listeners, conns := s.Leaked(0); len(listeners) != 0 || len(conns) != 0 {
+		t.Errorf("Unexpected leaks %q, %q", listeners, conns)
+	}
+}
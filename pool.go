@@ -0,0 +1,85 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "sync"
+
+// Pool keeps idle connections to a named listener, so that short lived
+// users can reuse them, rather than paying for a Dial and Accept each
+// time.  It is safe for concurrent use.
+type Pool struct {
+	mtx  sync.Mutex
+	name string
+	size int
+	idle []*ChanConn
+}
+
+// NewPool returns a pool of connections to the listener called name,
+// which keeps at most size idle connections.
+func NewPool(name string, size int) *Pool {
+	return &Pool{name: name, size: size}
+}
+
+// Get returns an idle connection from the pool, or dials a new one if
+// there are none.  Connections found to have been closed while idle are
+// discarded.
+func (p *Pool) Get() (*ChanConn, error) {
+	p.mtx.Lock()
+	for len(p.idle) > 0 {
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !conn.IsClosed() {
+			p.mtx.Unlock()
+			return conn, nil
+		}
+		conn.Close()
+	}
+	p.mtx.Unlock()
+	return DialChan(p.name)
+}
+
+// Put returns a connection obtained from Get to the pool.  If the
+// connection is closed, or the pool already holds as many idle connections
+// as it may, the connection is closed instead.
+func (p *Pool) Put(conn *ChanConn) {
+	p.mtx.Lock()
+	if !conn.IsClosed() && len(p.idle) < p.size {
+		p.idle = append(p.idle, conn)
+		conn = nil
+	}
+	p.mtx.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Len returns the number of idle connections in the pool.
+func (p *Pool) Len() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return len(p.idle)
+}
+
+// Close closes all of the idle connections.
+func (p *Pool) Close() error {
+	p.mtx.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mtx.Unlock()
+	for _, conn := range idle {
+		conn.Close()
+	}
+	return nil
+}
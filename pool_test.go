@@ -0,0 +1,120 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "testing"
+
+// servePool accepts connections on name until the listener is closed,
+// counting them.
+func servePool(t *testing.T, name string) (*ChanListener, chan int) {
+	listener, err := ListenChan(name)
+	if err != nil {
+		t.Fatalf("ListenChan failed: %v", err)
+	}
+	count := make(chan int, 1)
+	go func() {
+		n := 0
+		for {
+			if _, err := listener.AcceptChan(); err != nil {
+				count <- n
+				return
+			}
+			n++
+		}
+	}()
+	return listener, count
+}
+
+func TestPoolReuse(t *testing.T) {
+	listener, count := servePool(t, "testPoolReuse")
+	pool := NewPool("testPoolReuse", 2)
+
+	c1, err := pool.Get()
+	if err != nil {
+		t.Errorf("Get failed: %v", err)
+		return
+	}
+	pool.Put(c1)
+	c2, err := pool.Get()
+	if err != nil {
+		t.Errorf("Get failed: %v", err)
+		return
+	}
+	if c1 != c2 {
+		t.Errorf("Idle connection was not reused")
+	}
+	pool.Put(c2)
+	pool.Close()
+	listener.Close()
+	if n := <-count; n != 1 {
+		t.Errorf("Expected a single dial, got %d", n)
+	}
+}
+
+func TestPoolMaxSize(t *testing.T) {
+	listener, _ := servePool(t, "testPoolMaxSize")
+	defer listener.Close()
+	pool := NewPool("testPoolMaxSize", 2)
+	defer pool.Close()
+
+	var conns []*ChanConn
+	for i := 0; i < 3; i++ {
+		conn, err := pool.Get()
+		if err != nil {
+			t.Errorf("Get failed: %v", err)
+			return
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		pool.Put(conn)
+	}
+	if n := pool.Len(); n != 2 {
+		t.Errorf("Expected 2 idle connections, got %d", n)
+	}
+	if !conns[2].IsClosed() {
+		t.Errorf("Excess connection was not closed")
+	}
+}
+
+func TestPoolDiscardClosed(t *testing.T) {
+	listener, _ := servePool(t, "testPoolDiscardClosed")
+	defer listener.Close()
+	pool := NewPool("testPoolDiscardClosed", 2)
+	defer pool.Close()
+
+	c1, err := pool.Get()
+	if err != nil {
+		t.Errorf("Get failed: %v", err)
+		return
+	}
+	c1.Close()
+	pool.Put(c1)
+	if n := pool.Len(); n != 0 {
+		t.Errorf("Closed connection was pooled")
+	}
+
+	c2, _ := pool.Get()
+	pool.Put(c2)
+	c2.Close()
+	c3, err := pool.Get()
+	if err != nil {
+		t.Errorf("Get failed: %v", err)
+		return
+	}
+	if c3 == c2 {
+		t.Errorf("Connection closed while idle was reused")
+	}
+}
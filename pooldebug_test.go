@@ -0,0 +1,80 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build chanstreamdebug
+// +build chanstreamdebug
+
+package chanstream
+
+import "sync"
+import "testing"
+
+func TestPoolDebug(t *testing.T) {
+	buf := make([]byte, 8)
+	checkRecycle(buf)
+	expectPanic(t, "double recycle", func() { checkRecycle(buf) })
+	checkReuse(buf, false)
+	checkRecycle(buf)
+
+	buf[3] = 'x'
+	expectPanic(t, "use after recycle", func() { checkReuse(buf, false) })
+
+	// Buffers that were never recycled are not checked.
+	checkReuse(make([]byte, 8), false)
+}
+
+func TestPoolDebugPipe(t *testing.T) {
+	c1, c2 := PipeChan()
+	defer c2.Close()
+	c1.SetBufferPool(&sync.Pool{})
+	go func() {
+		for i := 0; i < 10000; i++ {
+			c1.Write([]byte{byte(i), byte(i >> 8)})
+		}
+		c1.Close()
+	}()
+	b := make([]byte, 1)
+	for {
+		if _, err := c2.Read(b); err != nil {
+			break
+		}
+	}
+}
+
+func TestPoolDebugSmallBuffer(t *testing.T) {
+	c1, c2 := PipeChan()
+	defer c1.Close()
+	defer c2.Close()
+	pool := &sync.Pool{}
+	c1.SetBufferPool(pool)
+
+	// A recycled buffer too small for the message is dropped, and so
+	// must not be remembered, or a new buffer at its address would look
+	// like it had been used after it was recycled.  The pool may drop
+	// the buffer itself, so try a few times.
+	for i := 0; i < 100; i++ {
+		small := make([]byte, 4)
+		checkRecycle(small)
+		pool.Put(small)
+		c1.alloc(100)
+		recycled.mtx.Lock()
+		kept := recycled.m[&small[0]]
+		delete(recycled.m, &small[0])
+		recycled.mtx.Unlock()
+		if !kept {
+			return
+		}
+	}
+	t.Errorf("Dropped buffer still noted as recycled")
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "net/rpc"
+import "testing"
+
+// Arith is a service for exercising net/rpc.
+type Arith struct{}
+
+type ArithArgs struct {
+	A, B int
+}
+
+func (Arith) Multiply(args *ArithArgs, reply *int) error {
+	*reply = args.A * args.B
+	return nil
+}
+
+func TestRPC(t *testing.T) {
+	leakCheck(t)
+	listener, err := ListenChan("rpc")
+	if err != nil {
+		t.Errorf("Failed to listen: %v", err)
+		return
+	}
+	server := rpc.NewServer()
+	if err := server.Register(Arith{}); err != nil {
+		t.Errorf("Failed to register: %v", err)
+		return
+	}
+	served := make(chan struct{})
+	go func() {
+		// This serves each connection in its own goroutine, until
+		// the listener is closed.
+		server.Accept(listener)
+		close(served)
+	}()
+
+	conn, err := DialChan("rpc")
+	if err != nil {
+		t.Errorf("Failed to dial: %v", err)
+		return
+	}
+	client := rpc.NewClient(conn)
+	for i := 0; i < 10; i++ {
+		var reply int
+		err := client.Call("Arith.Multiply", &ArithArgs{i, 7}, &reply)
+		if err != nil || reply != i*7 {
+			t.Errorf("Call %d: got %d, %v", i, reply, err)
+			break
+		}
+	}
+
+	// Concurrent calls share the connection.
+	calls := make([]*rpc.Call, 20)
+	for i := range calls {
+		calls[i] = client.Go("Arith.Multiply", &ArithArgs{i, i}, new(int), nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil || *call.Reply.(*int) != i*i {
+			t.Errorf("Call %d: got %d, %v", i, *call.Reply.(*int),
+				call.Error)
+		}
+	}
+
+	// Closing the client ends ServeConn, which closes the server side,
+	// as leakCheck verifies.
+	if err := client.Close(); err != nil {
+		t.Errorf("Failed to close client: %v", err)
+	}
+	listener.Close()
+	<-served
+}
+
+func TestRPCServerGone(t *testing.T) {
+	c1, c2 := PipeChan()
+	server := rpc.NewServer()
+	server.Register(Arith{})
+	go server.ServeConn(c2)
+
+	client := rpc.NewClient(c1)
+	defer client.Close()
+	var reply int
+	if err := client.Call("Arith.Multiply", &ArithArgs{6, 7}, &reply); err != nil || reply != 42 {
+		t.Errorf("Unexpected call %d, %v", reply, err)
+		return
+	}
+
+	// Calls fail, rather than hang, once the server has gone.
+	c2.Close()
+	if err := client.Call("Arith.Multiply", &ArithArgs{1, 1}, &reply); err == nil {
+		t.Errorf("Call succeeded after the server closed")
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "io"
+
+// Splice shuttles data between a and b, in both directions, until both
+// directions are finished, like an in-process proxy.  When one side
+// reaches EOF, the write side of the other is closed, so that half-closed
+// connections work as expected.  If copying in either direction fails,
+// both connections are closed, to stop the other direction, and the error
+// is returned.  Otherwise Splice returns nil, leaving the connections for
+// the caller to close.
+func Splice(a, b *ChanConn) error {
+	errs := make(chan error, 2)
+	pump := func(dst, src *ChanConn) {
+		_, err := io.Copy(dst, src)
+		if err == nil {
+			dst.CloseWrite()
+		}
+		errs <- err
+	}
+	go pump(a, b)
+	go pump(b, a)
+
+	var first error
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			a.Close()
+			b.Close()
+		}
+	}
+	return first
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 Garrett D'Amore
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use file except in compliance with the License.
+// You may obtain a copy of the license at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chanstream
+
+import "io"
+import "testing"
+
+func TestSplice(t *testing.T) {
+	c1, a := PipeChan()
+	b, c2 := PipeChan()
+	defer c1.Close()
+	defer c2.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- Splice(a, b)
+	}()
+
+	c1.Write([]byte("ping"))
+	buf := make([]byte, 10)
+	if n, err := c2.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("Unexpected read %q, %v", buf[:n], err)
+		return
+	}
+	c2.Write([]byte("pong"))
+	if n, err := c1.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Errorf("Unexpected read %q, %v", buf[:n], err)
+		return
+	}
+
+	// Half-close in one direction, and the other still works.
+	c1.CloseWrite()
+	if _, err := c2.Read(buf); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+		return
+	}
+	c2.Write([]byte("still here"))
+	if n, err := c1.Read(buf); err != nil || string(buf[:n]) != "still here" {
+		t.Errorf("Unexpected read %q, %v", buf[:n], err)
+		return
+	}
+
+	c2.CloseWrite()
+	if _, err := c1.Read(buf); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Splice failed: %v", err)
+	}
+	a.Close()
+	b.Close()
+}